@@ -0,0 +1,435 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/audit"
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/coast-team/mute-auth-proxy/metrics"
+	"github.com/dgraph-io/badger"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// adminBodyLimit is the maximum size of the admin API request bodies
+const adminBodyLimit = 8 << 10
+
+// The page sizes of the login listing
+const (
+	defaultAdminPageSize = 100
+	maxAdminPageSize     = 1000
+)
+
+// AdminLogin is a login in the admin listing
+type AdminLogin struct {
+	Login   string        `json:"login"`
+	Devices []string      `json:"devices"`
+	Blocked *blockedLogin `json:"blocked,omitempty"`
+}
+
+// AdminLoginPage is a page of the admin listing, Next is the after parameter of the next page
+type AdminLoginPage struct {
+	Logins []AdminLogin `json:"logins"`
+	Next   string       `json:"next,omitempty"`
+}
+
+// AdminLoginDetail is the keys and the state of a login
+type AdminLoginDetail struct {
+	Login     string               `json:"login"`
+	Devices   map[string]PublicKey `json:"devices"`
+	MasterKey *PublicKey           `json:"master_key,omitempty"`
+	Blocked   *blockedLogin        `json:"blocked,omitempty"`
+}
+
+// ArchivedKey is a key removed by the purge of the expired keys
+type ArchivedKey struct {
+	Device string `json:"deviceID"`
+	PublicKey
+	ArchivedAt time.Time `json:"archived_at"`
+}
+
+// KeyHistory is the key history of a login. Truncated is true when older changes were trimmed from the log.
+type KeyHistory struct {
+	Changes   []KeyChange   `json:"changes"`
+	Archived  []ArchivedKey `json:"archived"`
+	Truncated bool          `json:"truncated,omitempty"`
+}
+
+// tokenRevocation is the body of a revocation, of a token by its ID or of all the tokens of a login
+type tokenRevocation struct {
+	JTI       string     `json:"jti,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // of the token, its revocation is forgotten then
+	Login     string     `json:"login,omitempty"`
+}
+
+type loginBlock struct {
+	Reason string `json:"reason"`
+}
+
+// writeAdminJSON writes the response of an admin request
+func writeAdminJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.FromRequest(r).WithError(err).Error("Admin, couldn't write the response")
+	}
+}
+
+// MakeAdminLoginsHandler is the handler for the admin API to list the logins, in pages ordered by login
+func MakeAdminLoginsHandler(db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultAdminPageSize
+		if value := r.URL.Query().Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 || n > maxAdminPageSize {
+				helper.WriteProblem(w, helper.NewProblem(http.StatusBadRequest, helper.ProblemInvalidBody,
+					fmt.Sprintf("The limit must be between 1 and %d, got %q.", maxAdminPageSize, value)))
+				return
+			}
+			limit = n
+		}
+		start := time.Now()
+		page, err := listLogins(db, r.URL.Query().Get("after"), limit)
+		metrics.KeyStoreOperation("admin_list", start, storeOutcome(err))
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Error("Admin LIST failed")
+			return
+		}
+		writeAdminJSON(w, r, http.StatusOK, page)
+	}
+}
+
+// listLogins returns at most limit logins following after
+func listLogins(db *badger.DB, after string, limit int) (AdminLoginPage, error) {
+	page := AdminLoginPage{Logins: []AdminLogin{}}
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		// the "!" records sort before the logins
+		it.Seek([]byte(after + "\x00"))
+		for ; it.Valid(); it.Next() {
+			login := string(it.Item().Key())
+			// the device lists are stored under the logins, the other records have a colon in their key
+			if strings.HasPrefix(login, "!") || strings.Contains(login, ":") {
+				continue
+			}
+			if len(page.Logins) == limit {
+				page.Next = page.Logins[limit-1].Login
+				return nil
+			}
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			var devices []string
+			if json.Unmarshal(value, &devices) != nil {
+				continue
+			}
+			block, err := readBlockedLogin(txn, login)
+			if err != nil {
+				return err
+			}
+			page.Logins = append(page.Logins, AdminLogin{Login: login, Devices: devices, Blocked: block})
+		}
+		return nil
+	})
+	return page, err
+}
+
+// MakeAdminLoginHandler is the handler for the admin API to get the keys and the state of a login
+func MakeAdminLoginHandler(db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login := mux.Vars(r)["login"]
+		logging.AddFields(r, logrus.Fields{"login": login})
+		if err := checkKeyNames(login); err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Admin GET, invalid name")
+			return
+		}
+		start := time.Now()
+		detail, err := readLoginDetail(db, login)
+		metrics.KeyStoreOperation("admin_get", start, storeOutcome(err))
+		if err == badger.ErrKeyNotFound {
+			helper.WriteProblem(w, helper.NewProblem(http.StatusNotFound, helper.ProblemPKNotFound, fmt.Sprintf("No keys for %s.", login)))
+			return
+		} else if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Error("Admin GET failed")
+			return
+		}
+		writeAdminJSON(w, r, http.StatusOK, detail)
+	}
+}
+
+// readLoginDetail returns the keys of a login, expired ones included, badger.ErrKeyNotFound if it has
+// neither keys nor block
+func readLoginDetail(db *badger.DB, login string) (AdminLoginDetail, error) {
+	detail := AdminLoginDetail{Login: login, Devices: map[string]PublicKey{}}
+	err := db.View(func(txn *badger.Txn) error {
+		devices, err := readDeviceList(txn, login)
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		now := time.Now()
+		for _, device := range devices {
+			key, err := readStoredKey(txn, login, device)
+			if err == badger.ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			pk := key.public()
+			pk.Expired = key.expired(now)
+			detail.Devices[device] = pk
+		}
+		item, err := txn.Get(masterKeyKey(login))
+		if err == nil {
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			var master storedKey
+			if err = json.Unmarshal(value, &master); err != nil {
+				return err
+			}
+			pk := master.public()
+			detail.MasterKey = &pk
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		if detail.Blocked, err = readBlockedLogin(txn, login); err != nil {
+			return err
+		}
+		if len(detail.Devices) == 0 && detail.MasterKey == nil && detail.Blocked == nil {
+			return badger.ErrKeyNotFound
+		}
+		return nil
+	})
+	return detail, err
+}
+
+// MakeAdminKeyHistoryHandler is the handler for the admin API to get the key changes of a login and its archived keys
+func MakeAdminKeyHistoryHandler(db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login := mux.Vars(r)["login"]
+		logging.AddFields(r, logrus.Fields{"login": login})
+		if err := checkKeyNames(login); err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Admin HISTORY, invalid name")
+			return
+		}
+		start := time.Now()
+		history, err := readKeyHistory(db, login)
+		metrics.KeyStoreOperation("admin_history", start, storeOutcome(err))
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Error("Admin HISTORY failed")
+			return
+		}
+		writeAdminJSON(w, r, http.StatusOK, history)
+	}
+}
+
+// readKeyHistory returns the changes of the login still in the change log and its archived keys
+func readKeyHistory(db *badger.DB, login string) (KeyHistory, error) {
+	changes, _, gap, err := readKeyChanges(db, 0, []string{login})
+	if err != nil {
+		return KeyHistory{}, err
+	}
+	history := KeyHistory{Changes: changes, Archived: []ArchivedKey{}, Truncated: gap}
+	if history.Changes == nil {
+		history.Changes = []KeyChange{}
+	}
+	err = db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(fmt.Sprintf("!archive:%s:", login))
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			// the key is !archive:login:device:<time>
+			rest := strings.TrimPrefix(string(it.Item().Key()), string(prefix))
+			i := strings.LastIndex(rest, ":")
+			if i < 0 {
+				continue
+			}
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			var archived archivedKey
+			if err = json.Unmarshal(value, &archived); err != nil {
+				return err
+			}
+			history.Archived = append(history.Archived, ArchivedKey{Device: rest[:i], PublicKey: archived.public(), ArchivedAt: archived.ArchivedAt})
+		}
+		return nil
+	})
+	return history, err
+}
+
+// MakeAdminDeviceDELETEHandler is the handler for the admin API to force the deletion of a compromised device key
+func MakeAdminDeviceDELETEHandler(db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		login, device := vars["login"], vars["device"]
+		logging.AddFields(r, logrus.Fields{"login": login, "device": device})
+		admin := requestPrincipal(r)
+		if err := checkKeyNames(login, device); err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Admin DELETE, invalid name")
+			return
+		}
+		start := time.Now()
+		var fingerprint string
+		err := updateKeys(db, func(txn *badger.Txn) error {
+			key, err := readStoredKey(txn, login, device)
+			if err != nil {
+				return err
+			}
+			fingerprint = key.Fingerprint
+			return deleteDeviceKey(txn, login, device, ChangeKeyDeleted)
+		})
+		metrics.KeyStoreOperation("admin_delete", start, storeOutcome(err))
+		if err == badger.ErrKeyNotFound {
+			helper.WriteProblem(w, helper.NewProblem(http.StatusNotFound, helper.ProblemPKNotFound, fmt.Sprintf("No public key for %s:%s.", login, device)))
+			return
+		} else if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Error("Admin DELETE failed")
+			return
+		}
+		audit.Record(r, audit.Entry{Event: audit.EventKeyDeleted, Login: login, Device: device, Actor: admin.Login, Provider: admin.Provider,
+			Detail: fingerprint + " forced by admin"})
+		logging.FromRequest(r).Warn("Admin DELETE, device key removed")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// MakeAdminRevokeHandler is the handler for the admin API to revoke a token by its ID, or all the tokens of a login
+func MakeAdminRevokeHandler(db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin := requestPrincipal(r)
+		var revocation tokenRevocation
+		err := helper.DecodeJSON(w, r, adminBodyLimit, &revocation)
+		if err == nil && (revocation.JTI == "") == (revocation.Login == "") {
+			err = helper.NewProblemError(http.StatusBadRequest, helper.ProblemInvalidBody, "Give either the jti of a token or a login.", nil)
+		}
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Admin REVOKE, invalid body")
+			return
+		}
+		now := time.Now()
+		entry := audit.Entry{Event: audit.EventTokenRevoked, Login: revocation.Login, Actor: admin.Login, Provider: admin.Provider}
+		if revocation.JTI != "" {
+			var ttl time.Duration
+			if revocation.ExpiresAt != nil {
+				if ttl = revocation.ExpiresAt.Sub(now); ttl <= 0 {
+					helper.WriteProblem(w, helper.NewProblem(http.StatusBadRequest, helper.ProblemInvalidBody, "The token is already expired."))
+					return
+				}
+			}
+			err = revokeToken(db, revocation.JTI, ttl)
+			entry.Detail = "jti " + revocation.JTI
+		} else {
+			err = revokeLoginTokens(db, revocation.Login, now)
+			entry.Detail = "all the tokens issued before " + now.UTC().Format(time.RFC3339)
+		}
+		metrics.KeyStoreOperation("revoke", now, storeOutcome(err))
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Error("Admin REVOKE failed")
+			return
+		}
+		audit.Record(r, entry)
+		logging.FromRequest(r).WithField("detail", entry.Detail).Info("Admin REVOKE, tokens revoked")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// MakeAdminBlockPUTHandler is the handler for the admin API to block a login: its tokens are refused and
+// it can't sign in until it is unblocked
+func MakeAdminBlockPUTHandler(db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login := mux.Vars(r)["login"]
+		logging.AddFields(r, logrus.Fields{"login": login})
+		admin := requestPrincipal(r)
+		var body loginBlock
+		if r.ContentLength != 0 {
+			if err := helper.DecodeJSON(w, r, adminBodyLimit, &body); err != nil {
+				helper.WriteError(w, err)
+				logging.FromRequest(r).WithError(err).Warn("Admin BLOCK, invalid body")
+				return
+			}
+		}
+		block := blockedLogin{Since: time.Now().UTC().Truncate(time.Second), Reason: body.Reason, Actor: admin.Login}
+		start := time.Now()
+		value, err := json.Marshal(block)
+		if err == nil {
+			err = db.Update(func(txn *badger.Txn) error {
+				return txn.Set(blockedLoginKey(login), value)
+			})
+		}
+		metrics.KeyStoreOperation("block", start, storeOutcome(err))
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Error("Admin BLOCK failed")
+			return
+		}
+		audit.Record(r, audit.Entry{Event: audit.EventLoginBlocked, Login: login, Actor: admin.Login, Provider: admin.Provider, Detail: body.Reason})
+		logging.FromRequest(r).Warn("Admin BLOCK, login blocked")
+		writeAdminJSON(w, r, http.StatusOK, block)
+	}
+}
+
+// MakeAdminBlockDELETEHandler is the handler for the admin API to unblock a login
+func MakeAdminBlockDELETEHandler(db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login := mux.Vars(r)["login"]
+		logging.AddFields(r, logrus.Fields{"login": login})
+		admin := requestPrincipal(r)
+		start := time.Now()
+		err := db.Update(func(txn *badger.Txn) error {
+			if _, err := txn.Get(blockedLoginKey(login)); err != nil {
+				return err
+			}
+			return txn.Delete(blockedLoginKey(login))
+		})
+		metrics.KeyStoreOperation("unblock", start, storeOutcome(err))
+		if err == badger.ErrKeyNotFound {
+			helper.WriteProblem(w, helper.NewProblem(http.StatusNotFound, helper.ProblemNotFound, fmt.Sprintf("%s isn't blocked.", login)))
+			return
+		} else if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Error("Admin UNBLOCK failed")
+			return
+		}
+		audit.Record(r, audit.Entry{Event: audit.EventLoginUnblocked, Login: login, Actor: admin.Login, Provider: admin.Provider})
+		logging.FromRequest(r).Info("Admin UNBLOCK, login unblocked")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/metrics"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// authorize authenticates the request and checks that its token grants the scope.
+// The returned errors are *helper.ProblemError.
+func authorize(r *http.Request, scope string) (*jwt.Token, error) {
+	token, err := helper.Authenticate(r)
+	if err != nil {
+		return nil, helper.TokenProblem(helper.IsJWTValid(token, err))
+	}
+	if err = helper.CheckToken(token); err != nil {
+		metrics.JWTValidationFailure("revoked")
+		return nil, err
+	}
+	if !helper.HasScope(token, scope) {
+		metrics.JWTValidationFailure("scope")
+		return nil, helper.NewProblemError(http.StatusForbidden, helper.ProblemInsufficientScope,
+			fmt.Sprintf("The token doesn't grant the %s scope.", scope), nil)
+	}
+	return token, nil
+}
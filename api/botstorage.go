@@ -18,8 +18,9 @@
 package api
 
 import (
-	"log"
 	"net/http"
+
+	"github.com/coast-team/mute-auth-proxy/logging"
 )
 
 // MakeBotStorageProxyHandler is the handler for the route that proxies a request to the botstorage
@@ -27,7 +28,7 @@ func MakeBotStorageProxyHandler(p *BotStorageReverseProxy) func(w http.ResponseW
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := p.Handle(w, r)
 		if err != nil {
-			log.Printf("Botstorage Proxy err: %s\n", err)
+			logging.FromRequest(r).WithError(err).Warn("Botstorage proxy failed")
 		}
 	}
 }
@@ -0,0 +1,169 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/audit"
+	"github.com/coast-team/mute-auth-proxy/config"
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/keys"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/dgraph-io/badger"
+	"github.com/sirupsen/logrus"
+)
+
+// ChallengeRequest is the body of a request for a proof-of-possession challenge
+type ChallengeRequest struct {
+	Login  string `json:"login"`
+	Device string `json:"deviceID"`
+	Type   string `json:"type"`
+	Master bool   `json:"master"` // challenge the master key of the login instead of a device key
+}
+
+// ChallengeResponse is the challenge the client signs with the private key of the public key it registers
+type ChallengeResponse struct {
+	Challenge string    `json:"challenge"`
+	ServerKey string    `json:"server_key,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// storedChallenge is the record of a challenge in the key store, there is at most one per device
+type storedChallenge struct {
+	keys.Challenge
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// challengeKey is the key store key of the pending challenge of a device, logins can't start with "!"
+func challengeKey(login, device string) []byte {
+	return []byte(fmt.Sprintf("!challenge:%s:%s", login, device))
+}
+
+// masterChallengeKey is the key store key of the pending challenge of the master key of a login
+func masterChallengeKey(login string) []byte {
+	return []byte(fmt.Sprintf("!challenge-master:%s", login))
+}
+
+// MakePublicKeyChallengeHandler is the handler for the API to get the challenge to sign before adding
+// or updating the public key of a device, or the master key. A new challenge replaces the pending one.
+func MakePublicKeyChallengeHandler(conf *config.Config, db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ChallengeRequest
+		err := helper.DecodeJSON(w, r, int64(conf.BodyLimits.PublicKey), &req)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver CHALLENGE, couldn't parse the JSON body")
+			return
+		}
+		logging.AddFields(r, logrus.Fields{"login": req.Login, "device": req.Device})
+		if _, err = validateJWT(r, req.Login, true); err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver CHALLENGE, JWT validation failed")
+			return
+		}
+		if req.Master {
+			err = checkKeyNames(req.Login)
+		} else {
+			err = checkKeyNames(req.Login, req.Device)
+		}
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver CHALLENGE, invalid name")
+			return
+		}
+		device := req.Device
+		if req.Master {
+			device = ""
+		}
+		challenge, err := keys.NewChallenge(req.Type, req.Login, device, helper.GetSecret())
+		if err != nil {
+			if _, ok := err.(*keys.InvalidKeyError); ok {
+				err = invalidKeyProblem(err)
+			}
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver CHALLENGE, couldn't create the challenge")
+			return
+		}
+		stored := storedChallenge{Challenge: challenge, ExpiresAt: time.Now().Add(conf.PublicKey.ChallengeTTL.Duration).UTC()}
+		value, err := json.Marshal(stored)
+		if err == nil {
+			err = db.Update(func(txn *badger.Txn) error {
+				if req.Master {
+					return txn.Set(masterChallengeKey(req.Login), value)
+				}
+				return txn.Set(challengeKey(req.Login, req.Device), value)
+			})
+		}
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Error("Keyserver CHALLENGE, couldn't save the challenge")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(ChallengeResponse{Challenge: challenge.Nonce, ServerKey: challenge.ServerKey, ExpiresAt: stored.ExpiresAt})
+		if err != nil {
+			logging.FromRequest(r).WithError(err).Error("Keyserver CHALLENGE, couldn't write the response")
+		}
+	}
+}
+
+// proveKeyPossession consumes the pending challenge stored at slot and checks that signature answers it
+// with the private key of key. A challenge can only be answered once, whatever the outcome.
+// The returned errors are *helper.ProblemError.
+func proveKeyPossession(r *http.Request, db *badger.DB, actor, login, device string, slot []byte, key keys.Key, nonce, signature string) error {
+	var stored storedChallenge
+	err := db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(slot)
+		if err != nil {
+			return err
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(value, &stored); err != nil {
+			return err
+		}
+		return txn.Delete(slot)
+	})
+	if nonce == "" && (err == nil || err == badger.ErrKeyNotFound) {
+		err = helper.NewProblemError(http.StatusBadRequest, helper.ProblemChallengeInvalid,
+			"The challenge is missing, request one with POST /public-key/challenge.", nil)
+	} else if err == badger.ErrKeyNotFound || (err == nil && (stored.Nonce != nonce || stored.Login != login || stored.Device != device)) {
+		err = helper.NewProblemError(http.StatusBadRequest, helper.ProblemChallengeInvalid,
+			fmt.Sprintf("No pending challenge %q, request a new one.", nonce), err)
+	} else if err == nil && time.Now().After(stored.ExpiresAt) {
+		err = helper.NewProblemError(http.StatusBadRequest, helper.ProblemChallengeInvalid,
+			fmt.Sprintf("The challenge expired at %s, request a new one.", stored.ExpiresAt.Format(time.RFC3339)), nil)
+	} else if err == nil {
+		if proofErr := stored.Verify(key, signature, helper.GetSecret()); proofErr != nil {
+			err = helper.NewProblemError(http.StatusForbidden, helper.ProblemProofInvalid, proofErr.Error(), proofErr)
+		}
+	}
+	if problem, ok := err.(*helper.ProblemError); ok {
+		audit.Record(r, audit.Entry{Event: audit.EventAccessDenied, Login: login, Device: device, Actor: actor,
+			Detail: fmt.Sprintf("%s %s: %s", r.Method, r.URL.Path, problem.Type)})
+	}
+	return err
+}
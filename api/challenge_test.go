@@ -0,0 +1,129 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/keys"
+	"github.com/dgraph-io/badger"
+)
+
+func init() {
+	helper.SetSecret([]byte(strings.Repeat("k", 32)))
+}
+
+func TestCheckKeyNames(t *testing.T) {
+	tests := []struct {
+		login   string
+		devices []string
+		wantErr bool
+	}{
+		{"alice", []string{"laptop"}, false},
+		{"alice@github", nil, false},
+		{"", nil, true},
+		{"alice", []string{""}, true},
+		{"!challenge", []string{"alice:laptop"}, true},
+		{"!opk", nil, true},
+		{"alice", []string{"laptop", "!spk"}, true},
+		{"alice:laptop", nil, true},
+		{"alice", []string{"lap:top"}, true},
+	}
+	for _, tt := range tests {
+		err := checkKeyNames(tt.login, tt.devices...)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkKeyNames(%q, %q) error = %v, want error %t", tt.login, tt.devices, err, tt.wantErr)
+		}
+		if problem, ok := err.(*helper.ProblemError); err != nil && (!ok || problem.Type != helper.ProblemInvalidName) {
+			t.Errorf("checkKeyNames(%q, %q) error = %v, want an invalid-name problem", tt.login, tt.devices, err)
+		}
+	}
+}
+
+func TestProveKeyPossession(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	key, err := keys.Parse(keys.TypeEd25519, base64.StdEncoding.EncodeToString(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type answer struct {
+		device      string
+		nonce       string // the nonce of the stored challenge when empty
+		wrongProof  bool
+		wantProblem string
+	}
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		answers []answer
+	}{
+		{"answered once", time.Minute, []answer{{"laptop", "", false, ""}, {"laptop", "", false, helper.ProblemChallengeInvalid}}},
+		{"consumed by a wrong proof", time.Minute, []answer{{"laptop", "", true, helper.ProblemProofInvalid}, {"laptop", "", false, helper.ProblemChallengeInvalid}}},
+		{"other nonce", time.Minute, []answer{{"laptop", "other", false, helper.ProblemChallengeInvalid}}},
+		{"other device", time.Minute, []answer{{"phone", "", false, helper.ProblemChallengeInvalid}}},
+		{"expired", -time.Second, []answer{{"laptop", "", false, helper.ProblemChallengeInvalid}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t)
+			challenge, err := keys.NewChallenge(keys.TypeEd25519, "alice", "laptop", helper.GetSecret())
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, _ := json.Marshal(storedChallenge{Challenge: challenge, ExpiresAt: time.Now().Add(tt.ttl)})
+			err = db.Update(func(txn *badger.Txn) error {
+				return txn.Set(challengeKey("alice", "laptop"), value)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, a := range tt.answers {
+				nonce := a.nonce
+				if nonce == "" {
+					nonce = challenge.Nonce
+				}
+				message := challenge.Message()
+				if a.wrongProof {
+					message = []byte(nonce)
+				}
+				signature := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, message))
+				r := httptest.NewRequest("POST", "/public-key", nil)
+				err := proveKeyPossession(r, db, "alice", "alice", a.device, challengeKey("alice", a.device), key, nonce, signature)
+				got := ""
+				if err != nil {
+					problem, ok := err.(*helper.ProblemError)
+					if !ok {
+						t.Fatalf("answer %d: unexpected error %v", i, err)
+					}
+					got = problem.Type
+				}
+				if got != a.wantProblem {
+					t.Errorf("answer %d: problem %q, want %q", i, got, a.wantProblem)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// The types of the key changes, named after the audit events
+const (
+	ChangeKeyAdded     = "key_added"
+	ChangeKeyUpdated   = "key_updated"
+	ChangeKeyDeleted   = "key_deleted"
+	ChangeKeyExpired   = "key_expired"
+	ChangeMasterKeySet = "master_key_set"
+)
+
+// KeyChange is an entry of the change log of the device keys, its sequence number is the ID of the streamed event
+type KeyChange struct {
+	Seq         uint64    `json:"seq"`
+	Type        string    `json:"type"`
+	Login       string    `json:"login"`
+	Device      string    `json:"deviceID"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// changeSeqKey is the key store key of the sequence number of the last change
+var changeSeqKey = []byte("!change-seq")
+
+// changePrefix prefixes the change log entries, ordered by sequence number
+const changePrefix = "!change:"
+
+func changeKey(seq uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", changePrefix, seq))
+}
+
+// recordKeyChange appends the change to the log in the transaction making it. All the changes update the
+// sequence number, so that concurrent ones conflict and are committed in the order of their numbers.
+func recordKeyChange(txn *badger.Txn, change KeyChange) error {
+	seq, err := readChangeSeq(txn)
+	if err != nil {
+		return err
+	}
+	change.Seq = seq + 1
+	change.Time = time.Now().UTC()
+	value, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	if err = txn.Set(changeKey(change.Seq), value); err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, change.Seq)
+	if err = txn.Set(changeSeqKey, buf); err != nil {
+		return err
+	}
+	return touchLogin(txn, change.Login)
+}
+
+// readChangeSeq returns the sequence number of the last change, 0 if there was none
+func readChangeSeq(txn *badger.Txn) (uint64, error) {
+	item, err := txn.Get(changeSeqKey)
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil || len(value) != 8 {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+// readKeyChanges returns the changes of the logins made after the change after, and the sequence number of the last change.
+// gap is true when the changes following after were trimmed from the log, or when after is unknown.
+func readKeyChanges(db *badger.DB, after uint64, logins []string) (changes []KeyChange, last uint64, gap bool, err error) {
+	err = db.View(func(txn *badger.Txn) error {
+		seq, err := readChangeSeq(txn)
+		if err != nil {
+			return err
+		}
+		last = seq
+		if after > seq {
+			gap = true
+			return nil
+		}
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(changePrefix)
+		next := after + 1
+		for it.Seek(changeKey(next)); it.ValidForPrefix(prefix); it.Next() {
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			var change KeyChange
+			if err = json.Unmarshal(value, &change); err != nil {
+				return err
+			}
+			if change.Seq != next {
+				gap = true
+				return nil
+			}
+			next++
+			for _, login := range logins {
+				if change.Login == login {
+					changes = append(changes, change)
+					break
+				}
+			}
+		}
+		gap = next <= seq
+		return nil
+	})
+	return changes, last, gap, err
+}
+
+// TrimKeyChanges removes the changes made before the given time from the log and returns how many were removed
+func TrimKeyChanges(db *badger.DB, before time.Time) (int, error) {
+	var old [][]byte
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(changePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			var change KeyChange
+			if err = json.Unmarshal(value, &change); err != nil {
+				return err
+			}
+			if !change.Time.Before(before) {
+				break
+			}
+			old = append(old, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	// a transaction is limited in size, the entries are deleted in batches
+	trimmed := 0
+	for len(old) > 0 {
+		batch := old
+		if len(batch) > 1000 {
+			batch = batch[:1000]
+		}
+		err = db.Update(func(txn *badger.Txn) error {
+			for _, key := range batch {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return trimmed, err
+		}
+		trimmed += len(batch)
+		old = old[len(batch):]
+	}
+	return trimmed, nil
+}
+
+// changeNotifier wakes up the event streams when key changes are committed
+type changeNotifier struct {
+	mu     sync.Mutex
+	wake   chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+// keyChanges notifies the event streams of this process
+var keyChanges = &changeNotifier{wake: make(chan struct{}), closed: make(chan struct{})}
+
+// changed wakes up the streams waiting for a change
+func (n *changeNotifier) changed() {
+	n.mu.Lock()
+	close(n.wake)
+	n.wake = make(chan struct{})
+	n.mu.Unlock()
+}
+
+// wait returns a channel closed at the next change, to take before reading the log so that no change is missed
+func (n *changeNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.wake
+}
+
+// CloseKeyEventStreams ends the event streams, so that they don't hold the graceful shutdown
+func CloseKeyEventStreams() {
+	keyChanges.once.Do(func() { close(keyChanges.closed) })
+}
+
+// updateKeys runs a transaction changing the device keys, retried when it conflicts with another change,
+// and wakes up the event streams once it is committed
+func updateKeys(db *badger.DB, fn func(txn *badger.Txn) error) error {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if err = db.Update(fn); err != badger.ErrConflict {
+			break
+		}
+	}
+	if err == nil {
+		keyChanges.changed()
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/dgraph-io/badger"
+)
+
+// modifiedKey is the key store key of the date of the last change to the device keys of a login
+func modifiedKey(login string) []byte {
+	return []byte(fmt.Sprintf("!modified:%s", login))
+}
+
+// touchLogin records a change to the device keys of a login, in the transaction making it
+func touchLogin(txn *badger.Txn, login string) error {
+	value, err := time.Now().UTC().MarshalText()
+	if err != nil {
+		return err
+	}
+	return txn.Set(modifiedKey(login), value)
+}
+
+// lastModified returns the date of the last change to the device keys of a login,
+// zero if it changed before the dates were recorded
+func lastModified(db *badger.DB, login string) time.Time {
+	var modified time.Time
+	db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(modifiedKey(login))
+		if err != nil {
+			return err
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		return modified.UnmarshalText(value)
+	})
+	return modified
+}
+
+// keyETag returns the entity tag of a device key, as served by the GET endpoint
+func keyETag(key storedKey) (string, error) {
+	body, err := json.Marshal(key.public())
+	if err != nil {
+		return "", err
+	}
+	return helper.ETag(body), nil
+}
+
+// checkIfMatch verifies the If-Match precondition of a request changing the current key of a device
+func checkIfMatch(r *http.Request, login, device string, current storedKey) error {
+	if r.Header.Get("If-Match") == "" {
+		return nil
+	}
+	etag, err := keyETag(current)
+	if err != nil {
+		return err
+	}
+	if !helper.IfMatch(r, etag) {
+		return helper.NewProblemError(http.StatusPreconditionFailed, helper.ProblemPreconditionFailed,
+			fmt.Sprintf("The public key of %s:%s changed, its ETag is now %s.", login, device, etag), nil)
+	}
+	return nil
+}
+
+// checkIfNoneMatch verifies the If-None-Match precondition of a request adding the key of a device
+// that already has one
+func checkIfNoneMatch(r *http.Request, login, device string, current storedKey) error {
+	if r.Header.Get("If-None-Match") == "" {
+		return nil
+	}
+	etag, err := keyETag(current)
+	if err != nil {
+		return err
+	}
+	if !helper.IfNoneMatch(r, etag) {
+		return helper.NewProblemError(http.StatusPreconditionFailed, helper.ProblemPreconditionFailed,
+			fmt.Sprintf("A public key is already registered for %s:%s, its ETag is %s.", login, device, etag), nil)
+	}
+	return nil
+}
@@ -22,61 +22,76 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/coast-team/mute-auth-proxy/config"
 	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/coast-team/mute-auth-proxy/metrics"
 )
 
+// ConiksScope is the scope a service client needs to go through the Coniks proxy
+const ConiksScope = "coniks"
+
 // MakeConiksProxyHandler is the handler for the route that proxies a Coniks request
 func MakeConiksProxyHandler(conf *config.Config) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := handleConiksProxy(w, r, conf)
 		if err != nil {
-			log.Printf("Coniks proxy err: %s\n", err)
+			logging.FromRequest(r).WithError(err).Warn("Coniks proxy failed")
 		}
 	}
 }
 
 func handleConiksProxy(w http.ResponseWriter, r *http.Request, conf *config.Config) error {
-	token, err := helper.ExtractJWT(r)
-	if err != nil {
-		err = helper.IsJWTValid(token, err)
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		return fmt.Errorf("Couldn't extract or validate the JWT.\nError was: %s", err)
+	if _, err := authorize(r, ConiksScope); err != nil {
+		helper.WriteError(w, err)
+		return err
 	}
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := helper.ReadBody(w, r, int64(conf.BodyLimits.Coniks))
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		helper.WriteError(w, err)
 		return fmt.Errorf("Couldn't read request's body.\nError was: %s", err)
 	}
 
+	u, err := url.Parse(conf.ConiksServerAddr)
+	if err != nil {
+		helper.WriteError(w, err)
+		return fmt.Errorf("Couldn't parse the ConiksServer address.\nError was: %s", err)
+	}
+	start := time.Now()
+	response, err := forwardToConiks(u, body)
+	metrics.UpstreamRequest("coniks", start, err)
+	if err != nil {
+		helper.WriteProblem(w, helper.NewProblem(http.StatusBadGateway, helper.ProblemUpstreamError, "The ConiksServer couldn't be reached."))
+		return err
+	}
+
+	w.Write(response)
+	return nil
+}
+
+// forwardToConiks sends the request's body to the ConiksServer and returns its response
+func forwardToConiks(u *url.URL, body []byte) ([]byte, error) {
 	tlsConf := &tls.Config{InsecureSkipVerify: true}
-	u, _ := url.Parse(conf.ConiksServerAddr)
 	conn, err := tls.Dial(u.Scheme, u.Host, tlsConf)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return fmt.Errorf("Couldn't establish connection to ConiksServer.\nError was: %s", err)
+		return nil, fmt.Errorf("Couldn't establish connection to ConiksServer.\nError was: %s", err)
 	}
 	defer conn.Close()
 
 	_, err = conn.Write(body)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return fmt.Errorf("Communication to ConiksServer failed. Tried to send:\n%s\nError was: %s", body, err)
+		return nil, fmt.Errorf("Communication to ConiksServer failed (%d bytes to send).\nError was: %s", len(body), err)
 	}
 	conn.CloseWrite() // writes EOF
 
 	var buf bytes.Buffer
 	_, err = io.Copy(&buf, conn)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return fmt.Errorf("Couldn't send ConiksServer's response to ConiksClient.\nError was: %s", err)
+		return nil, fmt.Errorf("Couldn't send ConiksServer's response to ConiksClient.\nError was: %s", err)
 	}
-
-	w.Write(buf.Bytes())
-	return nil
+	return buf.Bytes(), nil
 }
@@ -0,0 +1,140 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/config"
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/dgraph-io/badger"
+	"github.com/sirupsen/logrus"
+)
+
+// MakeKeyEventsHandler is the handler streaming the changes to the device keys of some logins as server-sent events.
+// The event IDs are the sequence numbers of the changes, a client resumes the stream with the Last-Event-ID header.
+func MakeKeyEventsHandler(conf *config.Config, db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := validateJWT(r, "", false)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver EVENTS, JWT validation failed")
+			return
+		}
+		logins := r.URL.Query()["login"]
+		last, err := eventStreamStart(r, db, logins, conf.PublicKey.MaxLookupBatch)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver EVENTS, invalid request")
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			helper.WriteError(w, fmt.Errorf("the response writer can't stream"))
+			logging.FromRequest(r).Error("Keyserver EVENTS, streaming unsupported")
+			return
+		}
+		// the stream outlives the write timeout of the server
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		logging.AddFields(r, logrus.Fields{"logins": len(logins)})
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(conf.PublicKey.EventsHeartbeat.Duration)
+		defer heartbeat.Stop()
+		for {
+			wake := keyChanges.wait()
+			changes, seq, gap, err := readKeyChanges(db, last, logins)
+			if err != nil {
+				logging.FromRequest(r).WithError(err).Error("Keyserver EVENTS, couldn't read the key changes")
+				return
+			}
+			if gap {
+				// the client missed changes, it has to fetch the keys again
+				fmt.Fprintf(w, "id: %d\nevent: reset\ndata: {\"seq\":%d}\n\n", seq, seq)
+				changes = nil
+			}
+			for _, change := range changes {
+				data, err := json.Marshal(change)
+				if err != nil {
+					logging.FromRequest(r).WithError(err).Error("Keyserver EVENTS, couldn't encode a key change")
+					return
+				}
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.Seq, change.Type, data)
+			}
+			if gap || len(changes) > 0 {
+				flusher.Flush()
+			}
+			last = seq
+			select {
+			case <-wake:
+			case <-heartbeat.C:
+				if _, err = fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			case <-keyChanges.closed:
+				return
+			}
+		}
+	}
+}
+
+// eventStreamStart checks the logins of an event stream and returns the sequence number it starts after:
+// the Last-Event-ID of a resumed stream (or the last_event_id parameter), the current one otherwise
+func eventStreamStart(r *http.Request, db *badger.DB, logins []string, max int) (uint64, error) {
+	if len(logins) == 0 {
+		return 0, helper.NewProblemError(http.StatusBadRequest, helper.ProblemInvalidBody, "Give the logins to follow as login parameters.", nil)
+	} else if len(logins) > max {
+		return 0, helper.NewProblemError(http.StatusBadRequest, helper.ProblemInvalidBody,
+			fmt.Sprintf("%d logins are followed, at most %d are allowed.", len(logins), max), nil)
+	}
+	for _, login := range logins {
+		if login == "" {
+			return 0, helper.NewProblemError(http.StatusBadRequest, helper.ProblemInvalidBody, "A login parameter is empty.", nil)
+		}
+	}
+	id := r.Header.Get("Last-Event-ID")
+	if id == "" {
+		id = r.URL.Query().Get("last_event_id")
+	}
+	if id != "" {
+		seq, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return 0, helper.NewProblemError(http.StatusBadRequest, helper.ProblemInvalidBody, fmt.Sprintf("The event ID %q is not a sequence number.", id), err)
+		}
+		return seq, nil
+	}
+	var seq uint64
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		seq, err = readChangeSeq(txn)
+		return err
+	})
+	return seq, err
+}
@@ -0,0 +1,220 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/audit"
+	"github.com/coast-team/mute-auth-proxy/config"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/coast-team/mute-auth-proxy/metrics"
+	"github.com/dgraph-io/badger"
+	"github.com/sirupsen/logrus"
+)
+
+// keyExpiry returns the expiry of a new key: the requested one, capped by the maximum lifetime (0 for no limit)
+func keyExpiry(requested *time.Time, maxLifetime time.Duration, now time.Time) (*time.Time, error) {
+	if requested != nil && !requested.After(now) {
+		return nil, fmt.Errorf("The expiry date %s is in the past", requested.Format(time.RFC3339))
+	}
+	if maxLifetime > 0 {
+		limit := now.Add(maxLifetime).UTC().Truncate(time.Second)
+		if requested == nil || requested.After(limit) {
+			return &limit, nil
+		}
+	}
+	if requested == nil {
+		return nil, nil
+	}
+	expiresAt := requested.UTC()
+	return &expiresAt, nil
+}
+
+func (k storedKey) expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !k.ExpiresAt.After(now)
+}
+
+// warnExpiringKey adds a Warning header to the response to the owner of a key that expires within window
+func warnExpiringKey(w http.ResponseWriter, login, device string, pk PublicKey, window time.Duration) {
+	if pk.ExpiresAt == nil || pk.Expired || time.Until(*pk.ExpiresAt) > window {
+		return
+	}
+	w.Header().Add("Warning", fmt.Sprintf(`199 - "The public key of %s:%s expires at %s, rotate it"`, login, device, pk.ExpiresAt.Format(time.RFC3339)))
+}
+
+// archivedKey is the record of an expired key kept by the purge
+type archivedKey struct {
+	storedKey
+	ArchivedAt time.Time `json:"archived_at"`
+}
+
+func archivedKeyKey(login, device string, at time.Time) []byte {
+	return []byte(fmt.Sprintf("!archive:%s:%s:%020d", login, device, at.UnixNano()))
+}
+
+// KeyPurger periodically removes the expired device keys, with their prekeys
+type KeyPurger struct {
+	db        *badger.DB
+	interval  time.Duration
+	archive   bool
+	retention time.Duration // of the key change log, 0 to keep it all
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewKeyPurger returns the purger configured by the public_key section, Run must be called to start it
+func NewKeyPurger(db *badger.DB, conf config.PublicKeyConfig) *KeyPurger {
+	return &KeyPurger{db: db, interval: conf.PurgeInterval.Duration, archive: conf.ArchiveExpiredKeys,
+		retention: conf.ChangeRetention.Duration, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Run purges the expired keys and trims the key change log every interval until Stop is called,
+// it returns at once if the purge is disabled
+func (p *KeyPurger) Run() {
+	defer close(p.done)
+	if p.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			start := time.Now()
+			n, err := PurgeExpiredKeys(p.db, p.archive, start)
+			metrics.KeyStoreOperation("purge_expired", start, storeOutcome(err))
+			if err != nil {
+				logging.Log.WithError(err).Error("Couldn't purge the expired keys")
+			} else if n > 0 {
+				logging.Log.WithFields(logrus.Fields{"count": n, "archived": p.archive}).Info("Purged the expired keys")
+			}
+			if p.retention > 0 {
+				start = time.Now()
+				n, err = TrimKeyChanges(p.db, start.Add(-p.retention))
+				metrics.KeyStoreOperation("trim_changes", start, storeOutcome(err))
+				if err != nil {
+					logging.Log.WithError(err).Error("Couldn't trim the key change log")
+				} else if n > 0 {
+					logging.Log.WithField("count", n).Debug("Trimmed the key change log")
+				}
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the purger and waits for the purge in progress
+func (p *KeyPurger) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+// PurgeExpiredKeys removes the device keys expired at now, archiving them if archive is true,
+// and returns how many were removed
+func PurgeExpiredKeys(db *badger.DB, archive bool, now time.Time) (int, error) {
+	type device struct{ login, name string }
+	var expired []device
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			login := string(it.Item().Key())
+			// the device lists are stored under the logins, the other records have a colon in their key
+			if strings.HasPrefix(login, "!") || strings.Contains(login, ":") {
+				continue
+			}
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			var devices []string
+			if json.Unmarshal(value, &devices) != nil {
+				continue
+			}
+			for _, name := range devices {
+				item, err := txn.Get([]byte(fmt.Sprintf("%s:%s", login, name)))
+				if err == badger.ErrKeyNotFound {
+					continue
+				} else if err != nil {
+					return err
+				}
+				value, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				if decodeKey(value).expired(now) {
+					expired = append(expired, device{login, name})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, d := range expired {
+		var key storedKey
+		err = db.Update(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte(fmt.Sprintf("%s:%s", d.login, d.name)))
+			if err != nil {
+				return err
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			// the key may have been rotated since it was listed
+			if key = decodeKey(value); !key.expired(now) {
+				return badger.ErrKeyNotFound
+			}
+			if archive {
+				value, err = json.Marshal(archivedKey{storedKey: key, ArchivedAt: now.UTC()})
+				if err != nil {
+					return err
+				}
+				if err = txn.Set(archivedKeyKey(d.login, d.name, now), value); err != nil {
+					return err
+				}
+			}
+			return deleteDeviceKey(txn, d.login, d.name, ChangeKeyExpired)
+		})
+		if err == badger.ErrKeyNotFound || err == badger.ErrConflict {
+			continue
+		} else if err != nil {
+			return purged, err
+		}
+		purged++
+		detail := key.Fingerprint + " deleted"
+		if archive {
+			detail = key.Fingerprint + " archived"
+		}
+		audit.Record(nil, audit.Entry{Event: audit.EventKeyExpired, Login: d.login, Device: d.name, Detail: detail})
+	}
+	if purged > 0 {
+		keyChanges.changed()
+	}
+	return purged, nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/config"
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/dgraph-io/badger"
+)
+
+// readinessProbeKey is the key read to check that the key store answers, it doesn't need to exist
+const readinessProbeKey = "__readyz"
+
+// CheckResult is the result of the check of a dependency, the errors are only logged
+// as they can tell the internal addresses
+type CheckResult struct {
+	Status     string  `json:"status"` // ok or failed
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// Readiness is the response of the readiness route
+type Readiness struct {
+	Status string                 `json:"status"` // ready or not_ready
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// MakeHealthzHandler is the handler for the liveness route, it answers as long as the process serves requests
+func MakeHealthzHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	}
+}
+
+// MakeReadyzHandler is the handler for the readiness route. It checks the key store, the signing key,
+// the ConiksServer and the botstorage concurrently, each check being given conf.Health.CheckTimeout.
+func MakeReadyzHandler(conf *config.Config, db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func(ctx context.Context) error{
+		"keystore":    func(ctx context.Context) error { return checkKeyStore(db) },
+		"signing_key": func(ctx context.Context) error { return checkSigningKey() },
+		"coniks":      func(ctx context.Context) error { return checkConiks(ctx, conf.ConiksServerAddr) },
+		"botstorage":  func(ctx context.Context) error { return checkBotStorage(ctx, conf.BotStorageAddr) },
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		readiness := Readiness{Status: "ready", Checks: make(map[string]CheckResult)}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for name, check := range checks {
+			wg.Add(1)
+			go func(name string, check func(ctx context.Context) error) {
+				defer wg.Done()
+				result, err := runCheck(r.Context(), conf.Health.CheckTimeout.Duration, check)
+				if err != nil {
+					logging.FromRequest(r).WithError(err).WithField("check", name).Warn("Readiness check failed")
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				readiness.Checks[name] = result
+				if result.Status != "ok" {
+					readiness.Status = "not_ready"
+				}
+			}(name, check)
+		}
+		wg.Wait()
+
+		status := http.StatusOK
+		if readiness.Status != "ready" {
+			status = http.StatusServiceUnavailable
+			logging.FromRequest(r).Warn("Not ready")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(readiness)
+	}
+}
+
+// runCheck runs the check with a timeout and returns its result and error. A check that doesn't return
+// in time is reported as failed, it is left running in the background.
+func runCheck(parent context.Context, timeout time.Duration, check func(ctx context.Context) error) (CheckResult, error) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	result := CheckResult{Status: "ok", DurationMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Status = "failed"
+	}
+	return result, err
+}
+
+// checkKeyStore reads a key from the key store, a missing key is fine
+func checkKeyStore(db *badger.DB) error {
+	err := db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(readinessProbeKey))
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	return err
+}
+
+func checkSigningKey() error {
+	if !helper.HasSecret() {
+		return fmt.Errorf("the signing key is not loaded")
+	}
+	return nil
+}
+
+// checkConiks completes a TLS handshake with the ConiksServer
+func checkConiks(ctx context.Context, addr string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, u.Scheme, u.Host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	return tlsConn.Handshake()
+}
+
+// checkBotStorage sends a request to the botstorage, any response but a server error is fine
+func checkBotStorage(ctx context.Context, addr string) error {
+	req, err := http.NewRequest("GET", addr, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("the botstorage answered %s", resp.Status)
+	}
+	return nil
+}
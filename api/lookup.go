@@ -0,0 +1,172 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/config"
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/coast-team/mute-auth-proxy/metrics"
+	"github.com/dgraph-io/badger"
+	"github.com/sirupsen/logrus"
+)
+
+// LookupQuery asks for the public keys of some devices of a login, all of them if Devices is empty
+type LookupQuery struct {
+	Login   string   `json:"login"`
+	Devices []string `json:"devices,omitempty"`
+}
+
+// LookupResult is the public key of a device, or a not-found marker for a device or for a whole login
+type LookupResult struct {
+	Login    string     `json:"login"`
+	Device   string     `json:"deviceID,omitempty"`
+	Key      *PublicKey `json:"key,omitempty"`
+	NotFound bool       `json:"not_found,omitempty"`
+}
+
+// lookupRequest is the body of a batch lookup
+type lookupRequest struct {
+	Lookups []LookupQuery `json:"lookups"`
+}
+
+// lookupResponse lists the results in the order of the queries
+type lookupResponse struct {
+	Results []LookupResult `json:"results"`
+}
+
+// MakePublicKeyLookupHandler is the handler for the API to get the public keys of several users at once
+func MakePublicKeyLookupHandler(conf *config.Config, db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, err := validateJWT(r, "", false)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver LOOKUP, JWT validation failed")
+			return
+		}
+		var req lookupRequest
+		err = helper.DecodeJSON(w, r, int64(conf.BodyLimits.PublicKey), &req)
+		if err == nil {
+			err = validateLookup(req.Lookups, conf.PublicKey.MaxLookupBatch, actor)
+		}
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver LOOKUP, invalid request")
+			return
+		}
+		logging.AddFields(r, logrus.Fields{"lookups": len(req.Lookups)})
+		start := time.Now()
+		results, err := lookupPublicKeys(db, req.Lookups, conf.PublicKey.ExpiredKeys == "hide")
+		metrics.KeyStoreOperation("lookup", start, storeOutcome(err))
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Error("Keyserver LOOKUP failed")
+			return
+		}
+		for _, result := range results {
+			if result.Key != nil && validateLogin(result.Login, actor) == nil {
+				warnExpiringKey(w, result.Login, result.Device, *result.Key, conf.PublicKey.ExpiryWarning.Duration)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(lookupResponse{Results: results})
+		if err != nil {
+			logging.FromRequest(r).WithError(err).Error("Keyserver LOOKUP, couldn't write the response")
+		}
+	}
+}
+
+// validateLookup checks the queries, each device counts towards the batch size, a login without devices counts once.
+// Only the owner of a login can list its devices, as with GET /public-key/{login}, the others must give the device IDs.
+func validateLookup(queries []LookupQuery, max int, actor principal) error {
+	size := 0
+	for i, query := range queries {
+		if query.Login == "" {
+			return helper.NewProblemError(http.StatusBadRequest, helper.ProblemInvalidBody, fmt.Sprintf("The login of the lookup %d is empty.", i), nil)
+		}
+		for _, device := range query.Devices {
+			if device == "" {
+				return helper.NewProblemError(http.StatusBadRequest, helper.ProblemInvalidBody, fmt.Sprintf("The lookup %d has an empty device ID.", i), nil)
+			}
+		}
+		if err := checkKeyNames(query.Login, query.Devices...); err != nil {
+			return err
+		}
+		if len(query.Devices) == 0 && validateLogin(query.Login, actor) != nil {
+			metrics.JWTValidationFailure("login_mismatch")
+			return helper.NewProblemError(http.StatusForbidden, helper.ProblemLoginMismatch,
+				fmt.Sprintf("The token doesn't allow to list the devices of %s, give the device IDs of the lookup %d.", query.Login, i), nil)
+		}
+		if len(query.Devices) == 0 {
+			size++
+		} else {
+			size += len(query.Devices)
+		}
+	}
+	if size == 0 {
+		return helper.NewProblemError(http.StatusBadRequest, helper.ProblemInvalidBody, "The lookup list is empty.", nil)
+	}
+	if size > max {
+		return helper.NewProblemError(http.StatusBadRequest, helper.ProblemInvalidBody,
+			fmt.Sprintf("The lookup asks for %d logins and devices, at most %d are allowed.", size, max), nil)
+	}
+	return nil
+}
+
+// lookupPublicKeys reads the keys asked for in a single transaction, the expired keys are reported as not found when hidden
+func lookupPublicKeys(db *badger.DB, queries []LookupQuery, hideExpired bool) ([]LookupResult, error) {
+	var results []LookupResult
+	err := db.View(func(txn *badger.Txn) error {
+		for _, query := range queries {
+			devices := query.Devices
+			if len(devices) == 0 {
+				var err error
+				devices, err = readDeviceList(txn, query.Login)
+				if err == badger.ErrKeyNotFound || err == nil && len(devices) == 0 {
+					results = append(results, LookupResult{Login: query.Login, NotFound: true})
+					continue
+				} else if err != nil {
+					return err
+				}
+			}
+			for _, device := range devices {
+				key, err := readStoredKey(txn, query.Login, device)
+				if err == badger.ErrKeyNotFound {
+					results = append(results, LookupResult{Login: query.Login, Device: device, NotFound: true})
+					continue
+				} else if err != nil {
+					return err
+				}
+				pk := key.public()
+				if pk.Expired && hideExpired {
+					results = append(results, LookupResult{Login: query.Login, Device: device, NotFound: true})
+					continue
+				}
+				results = append(results, LookupResult{Login: query.Login, Device: device, Key: &pk})
+			}
+		}
+		return nil
+	})
+	return results, err
+}
@@ -0,0 +1,276 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/audit"
+	"github.com/coast-team/mute-auth-proxy/config"
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/keys"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/coast-team/mute-auth-proxy/metrics"
+	"github.com/dgraph-io/badger"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// MasterSigner is the signer of the cross-signatures made with the master key
+const MasterSigner = "master"
+
+// CrossSignature vouches for a key. The signer is the master key or a trusted device of the login, it
+// signs keys.CrossSignMessage with "device:<deviceID>" as subject for a device key, "master" for a new master key.
+type CrossSignature struct {
+	Signer            string `json:"signer"`
+	Signature         string `json:"signature"`
+	SignerFingerprint string `json:"signer_fingerprint,omitempty"` // set by the key server
+}
+
+// masterKeyKey is the key store key of the master key of a login
+func masterKeyKey(login string) []byte {
+	return []byte(fmt.Sprintf("!master:%s", login))
+}
+
+// getMasterKey returns the master key of a login, badger.ErrKeyNotFound if it has none
+func getMasterKey(db *badger.DB, login string) (storedKey, error) {
+	var key storedKey
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		key, err = readMasterKey(txn, login)
+		return err
+	})
+	return key, err
+}
+
+// readMasterKey reads the master key of a login in a transaction
+func readMasterKey(txn *badger.Txn, login string) (storedKey, error) {
+	var key storedKey
+	item, err := txn.Get(masterKeyKey(login))
+	if err != nil {
+		return key, err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return key, err
+	}
+	err = json.Unmarshal(value, &key)
+	return key, err
+}
+
+// checkCrossSignature verifies the cross-signature of the key of a device and returns it as stored.
+// It is optional until the login has a master key, then the signer must be the master key or a device
+// that is cross-signed itself. It reads the master key and the signer in the transaction writing the key.
+// The returned errors are *helper.ProblemError, except the key store ones.
+func checkCrossSignature(r *http.Request, txn *badger.Txn, actor, login, device string, key keys.Key, cs *CrossSignature) (*CrossSignature, error) {
+	master, err := readMasterKey(txn, login)
+	hasMaster := err == nil
+	if err != nil && err != badger.ErrKeyNotFound {
+		return nil, err
+	}
+	if cs == nil {
+		if hasMaster {
+			return nil, crossSignatureDenied(r, actor, login, device, helper.NewProblemError(http.StatusForbidden, helper.ProblemCrossSignatureRequired,
+				fmt.Sprintf("%s has a master key, the key of %s must be cross-signed by it or by a trusted device.", login, device), nil))
+		}
+		return nil, nil
+	}
+
+	var signer storedKey
+	switch {
+	case cs.Signer == MasterSigner && !hasMaster:
+		err = fmt.Errorf("%s has no master key", login)
+	case cs.Signer == MasterSigner:
+		signer = master
+	case cs.Signer == device:
+		err = fmt.Errorf("a device can't cross-sign its own key")
+	default:
+		signer, err = readStoredKey(txn, login, cs.Signer)
+		if err == badger.ErrKeyNotFound {
+			err = fmt.Errorf("%s has no device %s", login, cs.Signer)
+		} else if err != nil {
+			return nil, err
+		} else if hasMaster && signer.CrossSignature == nil {
+			err = fmt.Errorf("the device %s isn't cross-signed, it can't vouch for other devices", cs.Signer)
+		} else if signer.expired(time.Now()) {
+			err = fmt.Errorf("the key of the device %s expired", cs.Signer)
+		}
+	}
+	if err == nil {
+		err = keys.VerifySignature(signer.Key, keys.CrossSignMessage(login, "device:"+device, key), cs.Signature)
+	}
+	if err != nil {
+		return nil, crossSignatureDenied(r, actor, login, device, helper.NewProblemError(http.StatusForbidden, helper.ProblemCrossSignatureInvalid,
+			fmt.Sprintf("The cross-signature by %s is invalid: %s.", cs.Signer, err), err))
+	}
+	return &CrossSignature{Signer: cs.Signer, Signature: cs.Signature, SignerFingerprint: signer.Fingerprint}, nil
+}
+
+// crossSignatureDenied records the denial in the audit log
+func crossSignatureDenied(r *http.Request, actor, login, device string, problem *helper.ProblemError) error {
+	audit.Record(r, audit.Entry{Event: audit.EventAccessDenied, Login: login, Device: device, Actor: actor,
+		Detail: fmt.Sprintf("%s %s: %s", r.Method, r.URL.Path, problem.Type)})
+	return problem
+}
+
+// MakeMasterKeyGETHandler is the handler for the API to get the master key of an user
+func MakeMasterKeyGETHandler(db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login := mux.Vars(r)["login"]
+		logging.AddFields(r, logrus.Fields{"login": login})
+		_, err := validateJWT(r, login, false)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver GET MASTER, JWT validation failed")
+			return
+		}
+		if err = checkKeyNames(login); err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver GET MASTER, invalid name")
+			return
+		}
+		start := time.Now()
+		key, err := getMasterKey(db, login)
+		metrics.KeyStoreOperation("get_master", start, storeOutcome(err))
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				helper.WriteProblem(w, helper.NewProblem(http.StatusNotFound, helper.ProblemPKNotFound, fmt.Sprintf("No master key for %s.", login)))
+				logging.FromRequest(r).Info("Keyserver GET MASTER, no master key")
+			} else {
+				helper.WriteError(w, err)
+				logging.FromRequest(r).WithError(err).Error("Keyserver GET MASTER failed")
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(key.public())
+		if err != nil {
+			logging.FromRequest(r).WithError(err).Error("Keyserver GET MASTER, couldn't write the response")
+		}
+	}
+}
+
+// MakeMasterKeyPUTHandler is the handler for the API to set the master key of an user. The first master
+// key is trusted on first use, replacing it requires a cross-signature by the current one.
+func MakeMasterKeyPUTHandler(conf *config.Config, db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login := mux.Vars(r)["login"]
+		logging.AddFields(r, logrus.Fields{"login": login})
+		actor, err := validateJWT(r, login, true)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver SET MASTER, JWT validation failed")
+			return
+		}
+		if err = checkKeyNames(login); err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver SET MASTER, invalid name")
+			return
+		}
+		var pk publicKeyUpdate
+		err = helper.DecodeJSON(w, r, int64(conf.BodyLimits.PublicKey), &pk)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver SET MASTER, couldn't parse the JSON body")
+			return
+		}
+		key, err := keys.Parse(pk.Type, pk.PK)
+		if err == nil && !keys.CanSign(key.Type) {
+			err = fmt.Errorf("A master key must be able to sign, %s keys can't", key.Type)
+		}
+		if err != nil {
+			helper.WriteError(w, invalidKeyProblem(err))
+			logging.FromRequest(r).WithError(err).Warn("Keyserver SET MASTER, invalid PK")
+			return
+		}
+		err = proveKeyPossession(r, db, actor.Login, login, "", masterChallengeKey(login), key, pk.Challenge, pk.Signature)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver SET MASTER, proof of possession failed")
+			return
+		}
+		start := time.Now()
+		record, err := handleSetMasterKey(r, db, actor.Login, login, key, pk.CrossSignature)
+		metrics.KeyStoreOperation("set_master", start, storeOutcome(err))
+		if err != nil {
+			helper.WriteError(w, err)
+			if _, ok := err.(*helper.ProblemError); ok {
+				logging.FromRequest(r).WithError(err).Warn("Keyserver SET MASTER, cross-signature check failed")
+			} else {
+				logging.FromRequest(r).WithError(err).Error("Keyserver SET MASTER failed")
+			}
+			return
+		}
+		audit.Record(r, audit.Entry{Event: audit.EventMasterKeySet, Login: login, Actor: actor.Login, Detail: key.Fingerprint})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(record.public())
+		if err != nil {
+			logging.FromRequest(r).WithError(err).Error("Keyserver SET MASTER, couldn't write the response")
+		}
+	}
+}
+
+// handleSetMasterKey sets the master key of a login and records the change, the rotation is checked
+// against the current master key in the same transaction
+func handleSetMasterKey(r *http.Request, db *badger.DB, actor, login string, key keys.Key, cs *CrossSignature) (storedKey, error) {
+	var record storedKey
+	err := updateKeys(db, func(txn *badger.Txn) error {
+		var err error
+		if record, err = checkMasterRotation(r, txn, actor, login, key, cs); err != nil {
+			return err
+		}
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if err = txn.Set(masterKeyKey(login), value); err != nil {
+			return err
+		}
+		return recordKeyChange(txn, KeyChange{Type: ChangeMasterKeySet, Login: login, Fingerprint: key.Fingerprint})
+	})
+	return record, err
+}
+
+// checkMasterRotation verifies that the current master key, if any, cross-signed the new one
+func checkMasterRotation(r *http.Request, txn *badger.Txn, actor, login string, key keys.Key, cs *CrossSignature) (storedKey, error) {
+	current, err := readMasterKey(txn, login)
+	if err == badger.ErrKeyNotFound {
+		return storedKey{Key: key}, nil
+	} else if err != nil {
+		return storedKey{}, err
+	}
+	if cs == nil {
+		return storedKey{}, crossSignatureDenied(r, actor, login, "", helper.NewProblemError(http.StatusForbidden, helper.ProblemCrossSignatureRequired,
+			fmt.Sprintf("%s already has a master key, the new one must be cross-signed by it.", login), nil))
+	}
+	if cs.Signer != MasterSigner {
+		err = fmt.Errorf("only the current master key can sign a new master key")
+	} else {
+		err = keys.VerifySignature(current.Key, keys.CrossSignMessage(login, MasterSigner, key), cs.Signature)
+	}
+	if err != nil {
+		return storedKey{}, crossSignatureDenied(r, actor, login, "", helper.NewProblemError(http.StatusForbidden, helper.ProblemCrossSignatureInvalid,
+			fmt.Sprintf("The cross-signature by %s is invalid: %s.", cs.Signer, err), err))
+	}
+	return storedKey{Key: key, CrossSignature: &CrossSignature{Signer: MasterSigner, Signature: cs.Signature, SignerFingerprint: current.Fingerprint}}, nil
+}
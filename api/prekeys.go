@@ -0,0 +1,404 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/audit"
+	"github.com/coast-team/mute-auth-proxy/config"
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/keys"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/coast-team/mute-auth-proxy/metrics"
+	"github.com/dgraph-io/badger"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// SignedPrekey is the medium-term prekey of a device, signed by the device key (keys.SignedPrekeyMessage)
+type SignedPrekey struct {
+	ID          uint32 `json:"id"`
+	Type        string `json:"type"`
+	PK          string `json:"pk"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Signature   string `json:"signature"`
+}
+
+// OneTimePrekey is a prekey handed out to a single peer, of the type of the signed prekey
+type OneTimePrekey struct {
+	ID uint32 `json:"id"`
+	PK string `json:"pk"`
+}
+
+// PrekeyUpload is the body of a request to publish the prekeys of a device
+type PrekeyUpload struct {
+	SignedPrekey   *SignedPrekey   `json:"signed_prekey,omitempty"`
+	OneTimePrekeys []OneTimePrekey `json:"one_time_prekeys"`
+}
+
+// PrekeyCount tells the owner of a device how many one-time prekeys are left
+type PrekeyCount struct {
+	SignedPrekeyID *uint32 `json:"signed_prekey_id,omitempty"`
+	OneTimePrekeys int     `json:"one_time_prekeys"`
+	Replenish      bool    `json:"replenish"` // below the low watermark
+}
+
+// PrekeyBundle is what a peer needs to start a session with an offline device (X3DH).
+// OneTimePrekey is omitted when the device has run out of them.
+type PrekeyBundle struct {
+	Login         string         `json:"login"`
+	Device        string         `json:"deviceID"`
+	IdentityKey   PublicKey      `json:"identity_key"`
+	SignedPrekey  SignedPrekey   `json:"signed_prekey"`
+	OneTimePrekey *OneTimePrekey `json:"one_time_prekey,omitempty"`
+}
+
+func signedPrekeyKey(login, device string) []byte {
+	return []byte(fmt.Sprintf("!spk:%s:%s", login, device))
+}
+
+func oneTimePrekeyPrefix(login, device string) []byte {
+	return []byte(fmt.Sprintf("!opk:%s:%s:", login, device))
+}
+
+// the ids are zero-padded so the one-time prekeys are iterated in id order
+func oneTimePrekeyKey(login, device string, id uint32) []byte {
+	return append(oneTimePrekeyPrefix(login, device), fmt.Sprintf("%010d", id)...)
+}
+
+// oneTimePrekeyKeys returns the key store keys of the one-time prekeys of a device, in id order
+func oneTimePrekeyKeys(txn *badger.Txn, login, device string) [][]byte {
+	prefix := oneTimePrekeyPrefix(login, device)
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	var found [][]byte
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Item().KeyCopy(nil)
+		// skips the keys of a device whose name starts with this device's name and a colon
+		if _, err := strconv.ParseUint(string(key[len(prefix):]), 10, 32); err == nil && len(key) == len(prefix)+10 {
+			found = append(found, key)
+		}
+	}
+	return found
+}
+
+func getSignedPrekey(txn *badger.Txn, login, device string) (SignedPrekey, error) {
+	var spk SignedPrekey
+	item, err := txn.Get(signedPrekeyKey(login, device))
+	if err != nil {
+		return spk, err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return spk, err
+	}
+	err = json.Unmarshal(value, &spk)
+	return spk, err
+}
+
+// deletePrekeys removes the prekeys of a device
+func deletePrekeys(txn *badger.Txn, login, device string) error {
+	for _, key := range append(oneTimePrekeyKeys(txn, login, device), signedPrekeyKey(login, device)) {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func prekeyProblem(format string, a ...interface{}) error {
+	return helper.NewProblemError(http.StatusBadRequest, helper.ProblemPrekeyInvalid, fmt.Sprintf(format, a...), nil)
+}
+
+// writePrekeyCount writes the count with a Warning header when the owner should replenish the one-time prekeys
+func writePrekeyCount(w http.ResponseWriter, r *http.Request, count PrekeyCount) {
+	if count.Replenish {
+		w.Header().Set("Warning", fmt.Sprintf(`199 - "%d one-time prekeys left, replenish them"`, count.OneTimePrekeys))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(count); err != nil {
+		logging.FromRequest(r).WithError(err).Error("Keyserver PREKEYS, couldn't write the response")
+	}
+}
+
+// MakePrekeysPOSTHandler is the handler for the API to publish the signed prekey and to replenish the
+// one-time prekeys of a device
+func MakePrekeysPOSTHandler(conf *config.Config, db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		login := vars["login"]
+		device := vars["device"]
+		logging.AddFields(r, logrus.Fields{"login": login, "device": device})
+		actor, err := validateJWT(r, login, true)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver PREKEYS, JWT validation failed")
+			return
+		}
+		if err = checkKeyNames(login, device); err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver PREKEYS, invalid name")
+			return
+		}
+		var upload PrekeyUpload
+		err = helper.DecodeJSON(w, r, int64(conf.BodyLimits.PublicKey), &upload)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver PREKEYS, couldn't parse the JSON body")
+			return
+		}
+		start := time.Now()
+		count, err := handlePublishPrekeys(db, login, device, upload, conf.PublicKey)
+		metrics.KeyStoreOperation("publish_prekeys", start, storeOutcome(err))
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				helper.WriteProblem(w, helper.NewProblem(http.StatusNotFound, helper.ProblemPKNotFound, fmt.Sprintf("No public key for %s:%s.", login, device)))
+				logging.FromRequest(r).Info("Keyserver PREKEYS, PK not found")
+			} else {
+				helper.WriteError(w, err)
+				logging.FromRequest(r).WithError(err).Warn("Keyserver PREKEYS failed")
+			}
+			return
+		}
+		detail := fmt.Sprintf("%d one-time prekeys", len(upload.OneTimePrekeys))
+		if upload.SignedPrekey != nil {
+			detail = fmt.Sprintf("signed prekey %d, %s", upload.SignedPrekey.ID, detail)
+		}
+		audit.Record(r, audit.Entry{Event: audit.EventPrekeysPublished, Login: login, Device: device, Actor: actor.Login, Detail: detail})
+		writePrekeyCount(w, r, count)
+	}
+}
+
+func handlePublishPrekeys(db *badger.DB, login, device string, upload PrekeyUpload, conf config.PublicKeyConfig) (PrekeyCount, error) {
+	identity, err := getStoredKey(db, login, device)
+	if err != nil {
+		return PrekeyCount{}, err
+	}
+	var spk *SignedPrekey
+	if upload.SignedPrekey != nil {
+		spk = upload.SignedPrekey
+		if !keys.CanSign(identity.Type) {
+			return PrekeyCount{}, prekeyProblem("The %s key of %s:%s can't sign a prekey.", identity.Type, login, device)
+		}
+		if !keys.CanAgree(spk.Type) {
+			return PrekeyCount{}, prekeyProblem("A prekey must be a key agreement key (%s or %s), not %s.", keys.TypeX25519, keys.TypeECDHP256, spk.Type)
+		}
+		key, err := keys.Parse(spk.Type, spk.PK)
+		if err != nil {
+			return PrekeyCount{}, prekeyProblem("The signed prekey is invalid: %s.", err)
+		}
+		if err = keys.VerifySignature(identity.Key, keys.SignedPrekeyMessage(login, device, spk.ID, key), spk.Signature); err != nil {
+			return PrekeyCount{}, prekeyProblem("The signature of the signed prekey is invalid: %s.", err)
+		}
+		spk.PK, spk.Fingerprint = key.PK, key.Fingerprint
+	}
+
+	var count PrekeyCount
+	err = db.Update(func(txn *badger.Txn) error {
+		current, err := getSignedPrekey(txn, login, device)
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		hasCurrent := err == nil
+		existing := oneTimePrekeyKeys(txn, login, device)
+		if spk != nil {
+			if hasCurrent && current.Type != spk.Type {
+				// the one-time prekeys have the type of the signed prekey
+				for _, key := range existing {
+					if err = txn.Delete(key); err != nil {
+						return err
+					}
+				}
+				existing = nil
+			}
+			current, hasCurrent = *spk, true
+			value, err := json.Marshal(current)
+			if err != nil {
+				return err
+			}
+			if err = txn.Set(signedPrekeyKey(login, device), value); err != nil {
+				return err
+			}
+		}
+		if !hasCurrent {
+			return prekeyProblem("Publish a signed prekey for %s:%s first.", login, device)
+		}
+		if len(existing)+len(upload.OneTimePrekeys) > conf.MaxOneTimePrekeys {
+			return prekeyProblem("A device can have at most %d one-time prekeys, %d are left.", conf.MaxOneTimePrekeys, len(existing))
+		}
+		for _, opk := range upload.OneTimePrekeys {
+			key, err := keys.Parse(current.Type, opk.PK)
+			if err != nil {
+				return prekeyProblem("The one-time prekey %d is invalid: %s.", opk.ID, err)
+			}
+			storeKey := oneTimePrekeyKey(login, device, opk.ID)
+			if _, err = txn.Get(storeKey); err == nil {
+				return prekeyProblem("The one-time prekey %d is already published.", opk.ID)
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+			value, err := json.Marshal(OneTimePrekey{ID: opk.ID, PK: key.PK})
+			if err != nil {
+				return err
+			}
+			if err = txn.Set(storeKey, value); err != nil {
+				return err
+			}
+		}
+		id := current.ID
+		count = PrekeyCount{SignedPrekeyID: &id, OneTimePrekeys: len(existing) + len(upload.OneTimePrekeys)}
+		return nil
+	})
+	count.Replenish = count.OneTimePrekeys < conf.PrekeyLowWatermark
+	return count, err
+}
+
+// MakePrekeysGETHandler is the handler for the API to count the one-time prekeys left on a device
+func MakePrekeysGETHandler(conf *config.Config, db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		login := vars["login"]
+		device := vars["device"]
+		logging.AddFields(r, logrus.Fields{"login": login, "device": device})
+		_, err := validateJWT(r, login, true)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver PREKEYS COUNT, JWT validation failed")
+			return
+		}
+		if err = checkKeyNames(login, device); err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver PREKEYS COUNT, invalid name")
+			return
+		}
+		var count PrekeyCount
+		start := time.Now()
+		err = db.View(func(txn *badger.Txn) error {
+			spk, err := getSignedPrekey(txn, login, device)
+			if err == nil {
+				count.SignedPrekeyID = &spk.ID
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+			count.OneTimePrekeys = len(oneTimePrekeyKeys(txn, login, device))
+			return nil
+		})
+		metrics.KeyStoreOperation("count_prekeys", start, storeOutcome(err))
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Error("Keyserver PREKEYS COUNT failed")
+			return
+		}
+		count.Replenish = count.OneTimePrekeys < conf.PublicKey.PrekeyLowWatermark
+		writePrekeyCount(w, r, count)
+	}
+}
+
+// MakePrekeyBundleHandler is the handler for the API to get the prekey bundle of a device, it consumes
+// one of its one-time prekeys
+func MakePrekeyBundleHandler(conf *config.Config, db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		login := vars["login"]
+		device := vars["device"]
+		logging.AddFields(r, logrus.Fields{"login": login, "device": device})
+		_, err := validateJWT(r, login, false)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver BUNDLE, JWT validation failed")
+			return
+		}
+		if err = checkKeyNames(login, device); err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver BUNDLE, invalid name")
+			return
+		}
+		start := time.Now()
+		bundle, err := handleConsumePrekeyBundle(db, login, device, conf.PublicKey.ExpiredKeys == "hide")
+		metrics.KeyStoreOperation("consume_prekey", start, storeOutcome(err))
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				helper.WriteProblem(w, helper.NewProblem(http.StatusNotFound, helper.ProblemPKNotFound, fmt.Sprintf("No prekeys for %s:%s.", login, device)))
+				logging.FromRequest(r).Info("Keyserver BUNDLE, no prekeys")
+			} else {
+				helper.WriteError(w, err)
+				logging.FromRequest(r).WithError(err).Error("Keyserver BUNDLE failed")
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(bundle)
+		if err != nil {
+			logging.FromRequest(r).WithError(err).Error("Keyserver BUNDLE, couldn't write the response")
+		}
+	}
+}
+
+// handleConsumePrekeyBundle reads the bundle and deletes its one-time prekey in the same transaction,
+// so a one-time prekey is never handed out twice. Conflicting transactions are retried.
+// No one-time prekey is consumed when the device key expired and hideExpired is true.
+func handleConsumePrekeyBundle(db *badger.DB, login, device string, hideExpired bool) (bundle PrekeyBundle, err error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		bundle = PrekeyBundle{Login: login, Device: device}
+		err = db.Update(func(txn *badger.Txn) error {
+			identity, err := readStoredKey(txn, login, device)
+			if err != nil {
+				return err
+			}
+			bundle.IdentityKey = identity.public()
+			if bundle.IdentityKey.Expired && hideExpired {
+				return badger.ErrKeyNotFound
+			}
+			if bundle.SignedPrekey, err = getSignedPrekey(txn, login, device); err != nil {
+				return err
+			}
+			available := oneTimePrekeyKeys(txn, login, device)
+			if len(available) == 0 {
+				return nil
+			}
+			item, err := txn.Get(available[0])
+			if err != nil {
+				return err
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			var opk OneTimePrekey
+			if err = json.Unmarshal(value, &opk); err != nil {
+				return err
+			}
+			bundle.OneTimePrekey = &opk
+			return txn.Delete(available[0])
+		})
+		if err != badger.ErrConflict {
+			return bundle, err
+		}
+	}
+	return bundle, err
+}
@@ -0,0 +1,126 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/keys"
+	"github.com/dgraph-io/badger"
+)
+
+// openTestDB opens a key store in a temporary directory, closed at the end of the test
+func openTestDB(t *testing.T) *badger.DB {
+	t.Helper()
+	opts := badger.DefaultOptions
+	opts.Dir = t.TempDir()
+	opts.ValueDir = opts.Dir
+	db, err := badger.Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// storeTestPrekeys stores the key of login:device with a signed prekey and the one-time prekeys of the given ids
+func storeTestPrekeys(t *testing.T, db *badger.DB, login, device string, expiresAt *time.Time, ids ...uint32) {
+	t.Helper()
+	err := db.Update(func(txn *badger.Txn) error {
+		record, err := encodeKey(storedKey{Key: keys.Legacy("identity"), ExpiresAt: expiresAt})
+		if err != nil {
+			return err
+		}
+		if err = txn.Set([]byte(login+":"+device), record); err != nil {
+			return err
+		}
+		value, err := json.Marshal(SignedPrekey{ID: 1, Type: keys.TypeX25519, PK: "spk"})
+		if err != nil {
+			return err
+		}
+		if err = txn.Set(signedPrekeyKey(login, device), value); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if value, err = json.Marshal(OneTimePrekey{ID: id, PK: "opk"}); err != nil {
+				return err
+			}
+			if err = txn.Set(oneTimePrekeyKey(login, device, id), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countOneTimePrekeys(t *testing.T, db *badger.DB, login, device string) int {
+	t.Helper()
+	var count int
+	db.View(func(txn *badger.Txn) error {
+		count = len(oneTimePrekeyKeys(txn, login, device))
+		return nil
+	})
+	return count
+}
+
+func TestConsumePrekeyBundle(t *testing.T) {
+	expired := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name        string
+		expiresAt   *time.Time
+		hideExpired bool
+		published   []uint32
+		wantOPK     []uint32 // the one-time prekey handed out by each read, 0 for none
+		wantErr     error
+	}{
+		{"one prekey per read in id order", nil, true, []uint32{3, 1, 2}, []uint32{1, 2, 3}, nil},
+		{"no prekey left", nil, true, []uint32{7}, []uint32{7, 0, 0}, nil},
+		{"no prekey published", nil, true, nil, []uint32{0}, nil},
+		{"expired key shown", &expired, false, []uint32{1, 2}, []uint32{1}, nil},
+		{"expired key hidden", &expired, true, []uint32{1, 2}, []uint32{0}, badger.ErrKeyNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t)
+			storeTestPrekeys(t, db, "alice", "phone", tt.expiresAt, tt.published...)
+			left := len(tt.published)
+			for i, want := range tt.wantOPK {
+				bundle, err := handleConsumePrekeyBundle(db, "alice", "phone", tt.hideExpired)
+				if err != tt.wantErr {
+					t.Fatalf("read %d: error %v, want %v", i, err, tt.wantErr)
+				}
+				got := uint32(0)
+				if bundle.OneTimePrekey != nil {
+					got = bundle.OneTimePrekey.ID
+					left--
+				}
+				if got != want {
+					t.Errorf("read %d: one-time prekey %d, want %d", i, got, want)
+				}
+				if count := countOneTimePrekeys(t, db, "alice", "phone"); count != left {
+					t.Errorf("read %d: %d one-time prekeys left, want %d", i, count, left)
+				}
+			}
+		})
+	}
+}
@@ -18,39 +18,59 @@
 package api
 
 import (
-	"fmt"
-	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/coast-team/mute-auth-proxy/metrics"
 )
 
+// BotStorageScope is the scope a service client needs to go through the botstorage proxy
+const BotStorageScope = "botstorage"
+
 // BotStorageReverseProxy is a structure that contains the needed information for the proxy
 type BotStorageReverseProxy struct {
 	target         *url.URL               // URL of the target to which the requests are proxied
 	LocationPrefix string                 // The listening location path
 	proxy          *httputil.ReverseProxy // Actual http reverse proxy
+	transport      *http.Transport        // Connection pool to the target
 }
 
 // New creates a BotStorageReverseProxy given the ListeningPath and the target
 func New(listeningPath string, target string) *BotStorageReverseProxy {
 	url, _ := url.Parse(target)
-	return &BotStorageReverseProxy{target: url, LocationPrefix: listeningPath, proxy: httputil.NewSingleHostReverseProxy(url)}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	}
+	proxy := httputil.NewSingleHostReverseProxy(url)
+	proxy.Transport = metrics.InstrumentRoundTripper("botstorage", transport)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		logging.FromRequest(r).WithError(err).Warn("Botstorage proxy failed")
+		helper.WriteProblem(w, helper.NewProblem(http.StatusBadGateway, helper.ProblemUpstreamError, "The botstorage couldn't be reached."))
+	}
+	return &BotStorageReverseProxy{target: url, LocationPrefix: listeningPath, proxy: proxy, transport: transport}
+}
+
+// Close closes the idle connections to the botstorage, the active ones are closed once their request is done
+func (p *BotStorageReverseProxy) Close() {
+	p.transport.CloseIdleConnections()
 }
 
 // Handle checks the JWT and proxies the request to the botstorage
 func (p *BotStorageReverseProxy) Handle(w http.ResponseWriter, r *http.Request) error {
-	token, err := helper.ExtractJWT(r)
-	if err != nil {
-		err = helper.IsJWTValid(token, err)
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		return fmt.Errorf("Couldn't extract or validate the JWT.\nError was: %s", err)
+	if _, err := authorize(r, BotStorageScope); err != nil {
+		helper.WriteError(w, err)
+		return err
 	}
 	URI := strings.TrimPrefix(r.RequestURI, p.LocationPrefix)
-	log.Printf("Botstorage Proxy : URI -> %s", URI)
+	logging.FromRequest(r).WithField("uri", URI).Debug("Botstorage proxy request")
 	p.updateRequestURL(URI)
 	p.proxy.ServeHTTP(w, r)
 	return nil
@@ -3,31 +3,73 @@ package api
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/coast-team/mute-auth-proxy/audit"
+	"github.com/coast-team/mute-auth-proxy/config"
 	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/keys"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/coast-team/mute-auth-proxy/metrics"
 	"github.com/dgraph-io/badger"
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
 )
 
 // UserAllPK is the structure that contains all the public Keys of an user (one PK per device)
 type UserAllPK struct {
 	Login string
-	AllPK map[string]string
+	AllPK map[string]PublicKey
 }
 
-// PublicKey represents a public key in a JSON object
+// PublicKey represents a public key in a JSON object, the fingerprint is computed by the key server
 type PublicKey struct {
-	PK string `json:"pk"`
+	Type           string          `json:"type"`
+	PK             string          `json:"pk"`
+	Fingerprint    string          `json:"fingerprint,omitempty"`
+	CrossSignature *CrossSignature `json:"cross_signature,omitempty"`
+	ExpiresAt      *time.Time      `json:"expires_at,omitempty"`
+	Expired        bool            `json:"expired,omitempty"` // only returned when the expired keys are flagged
 }
 
 // UserPublicKey is the structure that contains the public key associate to an user and a device
 type UserPublicKey struct {
-	Login  string `json:"login"`
-	Device string `json:"deviceID"`
-	PK     string `json:"pk"`
+	Login          string          `json:"login"`
+	Device         string          `json:"deviceID"`
+	Type           string          `json:"type"`
+	PK             string          `json:"pk"`
+	Fingerprint    string          `json:"fingerprint,omitempty"`
+	CrossSignature *CrossSignature `json:"cross_signature,omitempty"`
+	ExpiresAt      *time.Time      `json:"expires_at,omitempty"`
+}
+
+// storedKey is the record of a public key in the key store
+type storedKey struct {
+	keys.Key
+	CrossSignature *CrossSignature `json:"cross_signature,omitempty"`
+	ExpiresAt      *time.Time      `json:"expires_at,omitempty"`
+}
+
+func (k storedKey) public() PublicKey {
+	return PublicKey{Type: k.Type, PK: k.PK, Fingerprint: k.Fingerprint, CrossSignature: k.CrossSignature,
+		ExpiresAt: k.ExpiresAt, Expired: k.expired(time.Now())}
+}
+
+// publicKeyRegistration is the body of a request to add a public key, with the answer to its challenge
+type publicKeyRegistration struct {
+	UserPublicKey
+	Challenge string `json:"challenge"`
+	Signature string `json:"signature"`
+}
+
+// publicKeyUpdate is the body of a request to update a public key, with the answer to its challenge
+type publicKeyUpdate struct {
+	PublicKey
+	Challenge string `json:"challenge"`
+	Signature string `json:"signature"`
 }
 
 type pkAlreadyExistsError struct {
@@ -49,349 +91,477 @@ func (e *deviceAlreadyExistsError) Error() string {
 
 // MakePublicKeyPOSTHandler is the handler for the API to save a public key
 // This public key is associated to an username and a deviceID
-func MakePublicKeyPOSTHandler(db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+func MakePublicKeyPOSTHandler(conf *config.Config, db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Body == nil {
-			http.Error(w, "Please send a request body", http.StatusBadRequest)
+		var registration publicKeyRegistration
+		err := helper.DecodeJSON(w, r, int64(conf.BodyLimits.PublicKey), &registration)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver ADD, couldn't parse the JSON body")
+			return
+		}
+		userPK := registration.UserPublicKey
+		logging.AddFields(r, logrus.Fields{"login": userPK.Login, "device": userPK.Device})
+		actor, err := validateJWT(r, userPK.Login, true)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver ADD, JWT validation failed")
+			return
+		}
+		if err = checkKeyNames(userPK.Login, userPK.Device); err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver ADD, invalid name")
+			return
+		}
+		key, err := keys.Parse(userPK.Type, userPK.PK)
+		if err != nil {
+			helper.WriteError(w, invalidKeyProblem(err))
+			logging.FromRequest(r).WithError(err).Warn("Keyserver ADD, invalid PK")
 			return
 		}
-		var userPK UserPublicKey
-		err := json.NewDecoder(r.Body).Decode(&userPK)
+		err = proveKeyPossession(r, db, actor.Login, userPK.Login, userPK.Device, challengeKey(userPK.Login, userPK.Device), key, registration.Challenge, registration.Signature)
 		if err != nil {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			log.Printf("Keyserver ADD, error while parsing JSON: %s\n", err)
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver ADD, proof of possession failed")
 			return
 		}
-		err = validateJWT(r, userPK.Login, true)
+		expiresAt, err := keyExpiry(userPK.ExpiresAt, conf.PublicKey.MaxKeyLifetime.Duration, time.Now())
 		if err != nil {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			log.Printf("Keyserver ADD, JWT validation err: %s\n", err)
+			helper.WriteError(w, helper.NewProblemError(http.StatusBadRequest, helper.ProblemInvalidBody, err.Error()+".", err))
+			logging.FromRequest(r).WithError(err).Warn("Keyserver ADD, invalid expiry")
 			return
 		}
-		addErr := handleAddPublicKey(db, userPK.Login, userPK.Device, userPK.PK)
+		start := time.Now()
+		record, addErr := handleAddPublicKey(r, db, actor.Login, userPK.Login, userPK.Device, storedKey{Key: key, ExpiresAt: expiresAt}, userPK.CrossSignature)
+		metrics.KeyStoreOperation("add", start, storeOutcome(addErr))
 		if addErr != nil {
-			if err, ok := addErr.(*pkAlreadyExistsError); ok {
-				http.Error(w,
-					fmt.Sprintf("%s - PK already registered for %s:%s", http.StatusText(http.StatusBadRequest), userPK.Login, userPK.Device),
-					http.StatusBadRequest)
-				log.Printf("Keyserver ADD err (pk already exists): %s\n", err)
-			} else {
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				log.Printf("Keyserver ADD err: %s\n", addErr)
+			switch addErr.(type) {
+			case *pkAlreadyExistsError, *deviceAlreadyExistsError:
+				helper.WriteProblem(w, helper.NewProblem(http.StatusConflict, helper.ProblemPKAlreadyExists,
+					fmt.Sprintf("A public key is already registered for %s:%s, update it with PUT.", userPK.Login, userPK.Device)))
+				logging.FromRequest(r).WithError(addErr).Info("Keyserver ADD, PK already exists")
+			case *helper.ProblemError:
+				helper.WriteError(w, addErr)
+				logging.FromRequest(r).WithError(addErr).Info("Keyserver ADD, precondition or cross-signature check failed")
+			default:
+				helper.WriteError(w, addErr)
+				logging.FromRequest(r).WithError(addErr).Error("Keyserver ADD failed")
 			}
 			return
 		}
+		audit.Record(r, audit.Entry{Event: audit.EventKeyAdded, Login: userPK.Login, Device: userPK.Device, Actor: actor.Login, Detail: key.Fingerprint})
+		userPK.Type, userPK.PK, userPK.Fingerprint, userPK.CrossSignature, userPK.ExpiresAt = key.Type, key.PK, key.Fingerprint, record.CrossSignature, expiresAt
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Location", fmt.Sprintf("/public-key/%s/%s", userPK.Login, userPK.Device))
 		w.WriteHeader(http.StatusCreated)
 		err = json.NewEncoder(w).Encode(userPK)
 		if err != nil {
-			log.Printf("Keyserver ADD err (response marshalling): %s\n", err)
+			logging.FromRequest(r).WithError(err).Error("Keyserver ADD, couldn't write the response")
 		}
 	}
 }
 
-func handleAddPublicKey(db *badger.DB, login, device, pk string) error {
-	log.Printf("Wanting to add PK %s for %s:%s", pk, login, device)
-	found, err := checkPKEntryAlreadyExists(db, login, device)
-	if err != nil {
-		return err
-	}
-	if found {
-		return &pkAlreadyExistsError{login, device}
-	}
-	found, err = checkPKListEntryAlreadyExists(db, login, device)
-	if err != nil {
-		return err
-	}
-	if found {
-		return &deviceAlreadyExistsError{login}
-	}
-	err = db.View(makeBDAddTxnHandler(db, login, device, pk))
-	return err
-}
-
-func checkPKEntryAlreadyExists(db *badger.DB, login, device string) (b bool, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = r.(error)
+// handleAddPublicKey adds the PK of a new device and the device to the login's device list. The device must
+// have no key yet, and the If-None-Match precondition of the request must hold when it has one.
+// The cross-signature is checked in the same transaction and the key is returned as stored.
+func handleAddPublicKey(r *http.Request, db *badger.DB, actor, login, device string, key storedKey, cs *CrossSignature) (storedKey, error) {
+	err := updateKeys(db, func(txn *badger.Txn) error {
+		current, err := readStoredKey(txn, login, device)
+		if err == nil {
+			if err = checkIfNoneMatch(r, login, device, current); err != nil {
+				return err
+			}
+			return &pkAlreadyExistsError{login, device}
+		} else if err != badger.ErrKeyNotFound {
+			return err
 		}
-	}()
-	err = db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(fmt.Sprintf("%s:%s", login, device)))
-		if err != nil {
+		devices, err := readDeviceList(txn, login)
+		if err != nil && err != badger.ErrKeyNotFound {
 			return err
 		}
-		pk, copyErr := item.ValueCopy(nil)
-		if copyErr != nil {
-			panic(copyErr)
+		if helper.StringInSlice(device, devices) {
+			return &deviceAlreadyExistsError{login}
 		}
-		log.Printf("Check PK entry : %s:%s - %s", login, device, pk)
-		return nil
-	})
-	if err == badger.ErrKeyNotFound {
-		return false, nil
-	}
-	return true, err
-}
-
-func checkPKListEntryAlreadyExists(db *badger.DB, login, device string) (b bool, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = r.(error)
+		if key.CrossSignature, err = checkCrossSignature(r, txn, actor, login, device, key.Key, cs); err != nil {
+			return err
 		}
-	}()
-	var devices []string
-	err = db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(login))
+		record, err := encodeKey(key)
 		if err != nil {
 			return err
 		}
-		pkList, copyErr := item.ValueCopy(nil)
-		if copyErr != nil {
-			panic(copyErr)
+		value, err := json.Marshal(append(devices, device))
+		if err != nil {
+			return err
 		}
-		jsonErr := json.Unmarshal(pkList, &devices)
-		if jsonErr != nil {
-			panic(jsonErr)
+		if err = txn.Set([]byte(fmt.Sprintf("%s:%s", login, device)), record); err != nil {
+			return err
 		}
-		log.Printf("Check devices entry : %s - %s", login, devices)
-		return nil
-	})
-	if err == badger.ErrKeyNotFound {
-		return false, nil
-	}
-	if !helper.StringInSlice(device, devices) {
-		return false, nil
-	}
-	return true, nil
-}
-
-func makeBDAddTxnHandler(db *badger.DB, login, device, pk string) func(txn *badger.Txn) error {
-	return func(txn *badger.Txn) (err error) {
-		defer func() {
-			if r := recover(); r != nil {
-				err = r.(error)
-			}
-		}()
-		var devices []string
-		getErr := db.View(func(txn *badger.Txn) error {
-			item, err := txn.Get([]byte(login))
-			if err != nil {
-				return err
-			}
-			pkList, copyErr := item.ValueCopy(nil)
-			if copyErr != nil {
-				panic(copyErr)
-			}
-			jsonErr := json.Unmarshal(pkList, &devices)
-			if jsonErr != nil {
-				panic(jsonErr)
-			}
-			return nil
-		})
-		if getErr != nil && getErr != badger.ErrKeyNotFound {
-			return getErr
+		if err = txn.Set([]byte(login), value); err != nil {
+			return err
 		}
-		devices = append(devices, device)
-		db.Update(func(txn *badger.Txn) error {
-			setErr := txn.Set([]byte(fmt.Sprintf("%s:%s", login, device)), []byte(pk))
-			if setErr != nil {
-				panic(setErr)
-			}
-			value, jsonErr := json.Marshal(devices)
-			if jsonErr != nil {
-				panic(jsonErr)
-			}
-			setErr = txn.Set([]byte(fmt.Sprintf("%s", login)), value)
-			if setErr != nil {
-				panic(setErr)
-			}
-			return nil
-		})
-		return
-	}
+		return recordKeyChange(txn, KeyChange{Type: ChangeKeyAdded, Login: login, Device: device, Fingerprint: key.Fingerprint})
+	})
+	return key, err
 }
 
 // MakePublicKeyGETHandler is the handler for the API to get a public key from a specific user and deviceID
-func MakePublicKeyGETHandler(db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+func MakePublicKeyGETHandler(conf *config.Config, db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		login := vars["login"]
 		device := vars["device"]
-		err := validateJWT(r, login, false)
+		logging.AddFields(r, logrus.Fields{"login": login, "device": device})
+		actor, err := validateJWT(r, login, false)
 		if err != nil {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			log.Printf("Keyserver GET, JWT validation err: %s\n", err)
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver GET, JWT validation failed")
 			return
 		}
+		if err = checkKeyNames(login, device); err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver GET, invalid name")
+			return
+		}
+		start := time.Now()
 		pk, err := handleGetPublicKey(db, login, device)
+		metrics.KeyStoreOperation("get", start, storeOutcome(err))
 		if err != nil {
 			if err == badger.ErrKeyNotFound {
-				http.Error(w,
-					fmt.Sprintf("%s - PK not found for %s:%s", http.StatusText(http.StatusNotFound), login, device),
-					http.StatusNotFound)
-				log.Printf("Keyserver GET err : PK not found for %s:%s\n", login, device)
+				helper.WriteProblem(w, helper.NewProblem(http.StatusNotFound, helper.ProblemPKNotFound, fmt.Sprintf("No public key for %s:%s.", login, device)))
+				logging.FromRequest(r).Info("Keyserver GET, PK not found")
 			} else {
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				log.Printf("Keyserver GET err: %s\n", err)
+				helper.WriteError(w, err)
+				logging.FromRequest(r).WithError(err).Error("Keyserver GET failed")
 			}
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		err = json.NewEncoder(w).Encode(pk)
+		if pk.Expired && conf.PublicKey.ExpiredKeys == "hide" {
+			helper.WriteProblem(w, helper.NewProblem(http.StatusNotFound, helper.ProblemPKNotFound,
+				fmt.Sprintf("The public key of %s:%s expired at %s.", login, device, pk.ExpiresAt.Format(time.RFC3339))))
+			logging.FromRequest(r).Info("Keyserver GET, PK expired")
+			return
+		}
+		if validateLogin(login, actor) == nil {
+			warnExpiringKey(w, login, device, pk, conf.PublicKey.ExpiryWarning.Duration)
+		}
+		err = helper.WriteCacheableJSON(w, r, pk, lastModified(db, login))
 		if err != nil {
-			log.Printf("Keyserver GET err (response marshalling): %s\n", err)
+			logging.FromRequest(r).WithError(err).Error("Keyserver GET, couldn't write the response")
 		}
 	}
 }
 
 func handleGetPublicKey(db *badger.DB, login, device string) (PublicKey, error) {
-	log.Printf("Get PK for : %s-%s", login, device)
-	var pk PublicKey
+	key, err := getStoredKey(db, login, device)
+	return key.public(), err
+}
+
+// getStoredKey returns the record of the public key of a device
+func getStoredKey(db *badger.DB, login, device string) (storedKey, error) {
+	var pk storedKey
 	err := db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(fmt.Sprintf("%s:%s", login, device)))
-		if err != nil {
-			return err
-		}
-		dbPK, copyErr := item.ValueCopy(nil)
-		pk.PK = string(dbPK)
-		if copyErr != nil {
-			return copyErr
-		}
-		log.Printf("Check PK entry : %s:%s - %s", login, device, pk)
-		return nil
+		var err error
+		pk, err = readStoredKey(txn, login, device)
+		return err
 	})
 	return pk, err
 }
 
+// readStoredKey reads the record of the public key of a device in a transaction,
+// the names that would address an internal record are not found
+func readStoredKey(txn *badger.Txn, login, device string) (storedKey, error) {
+	if !validKeyName(login) || !validKeyName(device) {
+		return storedKey{}, badger.ErrKeyNotFound
+	}
+	item, err := txn.Get([]byte(fmt.Sprintf("%s:%s", login, device)))
+	if err != nil {
+		return storedKey{}, err
+	}
+	dbPK, err := item.ValueCopy(nil)
+	if err != nil {
+		return storedKey{}, err
+	}
+	return decodeKey(dbPK), nil
+}
+
 // MakePublicKeyGETAllHandler is the handler for the API to get all the public keys of an user
-func MakePublicKeyGETAllHandler(db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+func MakePublicKeyGETAllHandler(conf *config.Config, db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		login := vars["login"]
-		device := vars["device"]
-		err := validateJWT(r, login, true)
+		logging.AddFields(r, logrus.Fields{"login": login})
+		_, err := validateJWT(r, login, true)
 		if err != nil {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			log.Printf("Keyserver GET ALL, JWT validation err: %s\n", err)
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver GET ALL, JWT validation failed")
 			return
 		}
+		if err = checkKeyNames(login); err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver GET ALL, invalid name")
+			return
+		}
+		start := time.Now()
 		allPK, err := handleGetAllPublicKeys(db, login)
+		metrics.KeyStoreOperation("get_all", start, storeOutcome(err))
 		if err != nil {
 			if err == badger.ErrKeyNotFound {
-				http.Error(w,
-					fmt.Sprintf("%s - PK not found for %s:%s", http.StatusText(http.StatusNotFound), login, device),
-					http.StatusNotFound)
-				log.Printf("Keyserver GET ALL err : PK not found for %s:%s\n", login, device)
+				helper.WriteProblem(w, helper.NewProblem(http.StatusNotFound, helper.ProblemPKNotFound, fmt.Sprintf("No public key for %s.", login)))
+				logging.FromRequest(r).Info("Keyserver GET ALL, no PK found")
 			} else {
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				log.Printf("Keyserver GET ALL err: %s\n", err)
+				helper.WriteError(w, err)
+				logging.FromRequest(r).WithError(err).Error("Keyserver GET ALL failed")
 			}
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		err = json.NewEncoder(w).Encode(allPK)
+		for device, pk := range allPK.AllPK {
+			if pk.Expired && conf.PublicKey.ExpiredKeys == "hide" {
+				delete(allPK.AllPK, device)
+			} else {
+				warnExpiringKey(w, login, device, pk, conf.PublicKey.ExpiryWarning.Duration)
+			}
+		}
+		err = helper.WriteCacheableJSON(w, r, allPK, lastModified(db, login))
 		if err != nil {
-			log.Printf("Keyserver GET err (response marshalling): %s\n", err)
+			logging.FromRequest(r).WithError(err).Error("Keyserver GET, couldn't write the response")
 		}
 	}
 }
 
 func handleGetAllPublicKeys(db *badger.DB, login string) (UserAllPK, error) {
-	log.Printf("Get devices for : %s", login)
 	var userAllPK UserAllPK
 	userAllPK.Login = login
-	userAllPK.AllPK = make(map[string]string)
+	userAllPK.AllPK = make(map[string]PublicKey)
 	err := db.View(func(txn *badger.Txn) error {
-		var deviceList []string
-		item, err := txn.Get([]byte(fmt.Sprintf("%s", login)))
+		deviceList, err := readDeviceList(txn, login)
 		if err != nil {
 			return err
 		}
-		devices, copyErr := item.ValueCopy(nil)
-		if copyErr != nil {
-			return copyErr
-		}
-		jsonErr := json.Unmarshal(devices, &deviceList)
-		if jsonErr != nil {
-			return jsonErr
-		}
-		log.Printf("Check devices entry : %s - %s", login, deviceList)
 		for _, device := range deviceList {
-			item, err := txn.Get([]byte(fmt.Sprintf("%s:%s", login, device)))
+			key, err := readStoredKey(txn, login, device)
 			if err != nil {
 				return err
 			}
-			pk, copyErr := item.ValueCopy(nil)
-			if copyErr != nil {
-				return copyErr
-			}
-			log.Printf("Check PK entry : %s:%s - %s", login, device, pk)
-			userAllPK.AllPK[device] = string(pk)
+			userAllPK.AllPK[device] = key.public()
 		}
 		return nil
 	})
-	log.Printf("Check All PK for %s - %#v", userAllPK.Login, userAllPK.AllPK)
 	return userAllPK, err
 }
 
+// readDeviceList reads the list of the devices of a login in a transaction,
+// the logins that would address an internal record are not found
+func readDeviceList(txn *badger.Txn, login string) ([]string, error) {
+	if !validKeyName(login) {
+		return nil, badger.ErrKeyNotFound
+	}
+	item, err := txn.Get([]byte(login))
+	if err != nil {
+		return nil, err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	var devices []string
+	err = json.Unmarshal(value, &devices)
+	return devices, err
+}
+
 // MakePublicKeyPUTHandler is the handler for the API to update a public key from an username deviceID
-func MakePublicKeyPUTHandler(db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+func MakePublicKeyPUTHandler(conf *config.Config, db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		login := vars["login"]
 		device := vars["device"]
-		err := validateJWT(r, login, true)
+		logging.AddFields(r, logrus.Fields{"login": login, "device": device})
+		actor, err := validateJWT(r, login, true)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver UPDATE, JWT validation failed")
+			return
+		}
+		if err = checkKeyNames(login, device); err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver UPDATE, invalid name")
+			return
+		}
+		var pk publicKeyUpdate
+		err = helper.DecodeJSON(w, r, int64(conf.BodyLimits.PublicKey), &pk)
 		if err != nil {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			log.Printf("Keyserver(PUT) JWT validation err: %s\n", err)
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver UPDATE, couldn't parse the JSON body")
 			return
 		}
-		var pk PublicKey
-		err = json.NewDecoder(r.Body).Decode(&pk)
+		key, err := keys.Parse(pk.Type, pk.PK)
 		if err != nil {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			log.Printf("Keyserver UPDATE, error while parsing JSON: %s\n", err)
+			helper.WriteError(w, invalidKeyProblem(err))
+			logging.FromRequest(r).WithError(err).Warn("Keyserver UPDATE, invalid PK")
 			return
 		}
-		err = handleUpdatePublicKeys(db, login, device, pk.PK)
+		err = proveKeyPossession(r, db, actor.Login, login, device, challengeKey(login, device), key, pk.Challenge, pk.Signature)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver UPDATE, proof of possession failed")
+			return
+		}
+		expiresAt, err := keyExpiry(pk.ExpiresAt, conf.PublicKey.MaxKeyLifetime.Duration, time.Now())
+		if err != nil {
+			helper.WriteError(w, helper.NewProblemError(http.StatusBadRequest, helper.ProblemInvalidBody, err.Error()+".", err))
+			logging.FromRequest(r).WithError(err).Warn("Keyserver UPDATE, invalid expiry")
+			return
+		}
+		start := time.Now()
+		record, err := handleUpdatePublicKeys(r, db, actor.Login, login, device, storedKey{Key: key, ExpiresAt: expiresAt}, pk.CrossSignature)
+		metrics.KeyStoreOperation("update", start, storeOutcome(err))
 		if err != nil {
 			if err == badger.ErrKeyNotFound {
-				http.Error(w,
-					fmt.Sprintf("%s - PK not found for %s:%s", http.StatusText(http.StatusNotFound), login, device),
-					http.StatusNotFound)
-				log.Printf("Keyserver UPDATE err : PK not found for %s:%s\n", login, device)
+				helper.WriteProblem(w, helper.NewProblem(http.StatusNotFound, helper.ProblemPKNotFound, fmt.Sprintf("No public key for %s:%s.", login, device)))
+				logging.FromRequest(r).Info("Keyserver UPDATE, PK not found")
+			} else if _, ok := err.(*helper.ProblemError); ok {
+				helper.WriteError(w, err)
+				logging.FromRequest(r).WithError(err).Info("Keyserver UPDATE, precondition or cross-signature check failed")
 			} else {
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				log.Printf("Keyserver update err: %s\n", err)
+				helper.WriteError(w, err)
+				logging.FromRequest(r).WithError(err).Error("Keyserver UPDATE failed")
 			}
 			return
 		}
+		audit.Record(r, audit.Entry{Event: audit.EventKeyUpdated, Login: login, Device: device, Actor: actor.Login, Detail: key.Fingerprint})
+		if etag, err := keyETag(record); err == nil {
+			w.Header().Set("ETag", etag)
+		}
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(record.public())
+		if err != nil {
+			logging.FromRequest(r).WithError(err).Error("Keyserver UPDATE, couldn't write the response")
+		}
+	}
+}
+
+// MakePublicKeyDELETEHandler is the handler for the API to delete the public key of a device
+func MakePublicKeyDELETEHandler(db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		login := vars["login"]
+		device := vars["device"]
+		logging.AddFields(r, logrus.Fields{"login": login, "device": device})
+		actor, err := validateJWT(r, login, true)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver DELETE, JWT validation failed")
+			return
+		}
+		if err = checkKeyNames(login, device); err != nil {
+			helper.WriteError(w, err)
+			logging.FromRequest(r).WithError(err).Warn("Keyserver DELETE, invalid name")
+			return
+		}
+		start := time.Now()
+		err = handleDeletePublicKey(r, db, login, device)
+		metrics.KeyStoreOperation("delete", start, storeOutcome(err))
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				helper.WriteProblem(w, helper.NewProblem(http.StatusNotFound, helper.ProblemPKNotFound, fmt.Sprintf("No public key for %s:%s.", login, device)))
+				logging.FromRequest(r).Info("Keyserver DELETE, PK not found")
+			} else {
+				helper.WriteError(w, err)
+				logging.FromRequest(r).WithError(err).Error("Keyserver DELETE failed")
+			}
+			return
+		}
+		audit.Record(r, audit.Entry{Event: audit.EventKeyDeleted, Login: login, Device: device, Actor: actor.Login})
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
-func handleUpdatePublicKeys(db *badger.DB, login, device, pk string) error {
-	log.Printf("Update PK for %s:%s, new value: %s", login, device, pk)
-	found, err := checkPKEntryAlreadyExists(db, login, device)
+// handleDeletePublicKey removes the PK of the device and the device from the login's device list,
+// if the If-Match precondition of the request holds
+func handleDeletePublicKey(r *http.Request, db *badger.DB, login, device string) error {
+	return updateKeys(db, func(txn *badger.Txn) error {
+		current, err := readStoredKey(txn, login, device)
+		if err != nil {
+			return err
+		}
+		if err = checkIfMatch(r, login, device, current); err != nil {
+			return err
+		}
+		return deleteDeviceKey(txn, login, device, ChangeKeyDeleted)
+	})
+}
+
+// deleteDeviceKey removes the PK and the prekeys of the device and the device from the login's device list,
+// and records the change with the given type
+func deleteDeviceKey(txn *badger.Txn, login, device, change string) error {
+	pkKey := []byte(fmt.Sprintf("%s:%s", login, device))
+	key, err := readStoredKey(txn, login, device)
 	if err != nil {
 		return err
 	}
-	if found {
-		err = db.Update(func(txn *badger.Txn) error {
-			setErr := txn.Set([]byte(fmt.Sprintf("%s:%s", login, device)), []byte(pk))
-			if setErr != nil {
-				panic(setErr)
-			}
-			return nil
-		})
-	} else {
-		err = badger.ErrKeyNotFound
+	if err = txn.Delete(pkKey); err != nil {
+		return err
+	}
+	if err = deletePrekeys(txn, login, device); err != nil {
+		return err
+	}
+	if err = recordKeyChange(txn, KeyChange{Type: change, Login: login, Device: device, Fingerprint: key.Fingerprint}); err != nil {
+		return err
+	}
+	item, err := txn.Get([]byte(login))
+	if err == badger.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
 	}
-	return err
+	var devices []string
+	if err = json.Unmarshal(value, &devices); err != nil {
+		return err
+	}
+	remaining := devices[:0]
+	for _, d := range devices {
+		if d != device {
+			remaining = append(remaining, d)
+		}
+	}
+	if len(remaining) == 0 {
+		return txn.Delete([]byte(login))
+	}
+	value, err = json.Marshal(remaining)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(login), value)
+}
+
+// handleUpdatePublicKeys replaces the PK of an existing device, if the If-Match precondition of the request holds.
+// The cross-signature is checked in the same transaction and the key is returned as stored.
+func handleUpdatePublicKeys(r *http.Request, db *badger.DB, actor, login, device string, key storedKey, cs *CrossSignature) (storedKey, error) {
+	err := updateKeys(db, func(txn *badger.Txn) error {
+		current, err := readStoredKey(txn, login, device)
+		if err != nil {
+			return err
+		}
+		if err = checkIfMatch(r, login, device, current); err != nil {
+			return err
+		}
+		if key.CrossSignature, err = checkCrossSignature(r, txn, actor, login, device, key.Key, cs); err != nil {
+			return err
+		}
+		record, err := encodeKey(key)
+		if err != nil {
+			return err
+		}
+		if err = txn.Set([]byte(fmt.Sprintf("%s:%s", login, device)), record); err != nil {
+			return err
+		}
+		return recordKeyChange(txn, KeyChange{Type: ChangeKeyUpdated, Login: login, Device: device, Fingerprint: key.Fingerprint})
+	})
+	return key, err
 }
 
 func makeBDUpdateTxnHandler(db *badger.DB, login, device, pk string) func(txn *badger.Txn) error {
@@ -440,27 +610,104 @@ func makeBDUpdateTxnHandler(db *badger.DB, login, device, pk string) func(txn *b
 	}
 }
 
-func validateJWT(r *http.Request, login string, checkLogin bool) error {
-	token, err := helper.ExtractJWT(r)
+// PublicKeyScope is the scope a service client needs to use the key server
+const PublicKeyScope = "public-key"
+
+// validateJWT checks the JWT of the request and returns the client it was issued to.
+// The denials are recorded in the audit log, the returned errors are *helper.ProblemError.
+func validateJWT(r *http.Request, login string, checkLogin bool) (principal, error) {
+	token, err := authorize(r, PublicKeyScope)
 	if err != nil {
-		err = helper.IsJWTValid(token, err)
-		return fmt.Errorf("Couldn't extract or validate the JWT.\nError was: %s", err)
+		entry := audit.Entry{Event: audit.EventAccessDenied, Login: login, Detail: fmt.Sprintf("%s %s: %s", r.Method, r.URL.Path, err.(*helper.ProblemError).Type)}
+		if token, _ := helper.Authenticate(r); token != nil && token.Valid {
+			entry.Actor, entry.Provider = tokenIdentity(token)
+		}
+		audit.Record(r, entry)
+		return principal{}, err
 	}
+	tokenLogin, provider := tokenIdentity(token)
+	actor := principal{Login: tokenLogin, Provider: provider, Roles: helper.TokenRoles(token)}
 	if checkLogin {
-		err = validateLogin(login, token.Claims.(jwt.MapClaims)["login"].(string))
+		err = validateLogin(login, actor)
 		if err != nil {
-			return fmt.Errorf("Unallowed get, creation or modification of a PK.\nError was: %s", err)
+			metrics.JWTValidationFailure("login_mismatch")
+			audit.Record(r, audit.Entry{Event: audit.EventAccessDenied, Login: login, Actor: tokenLogin, Provider: provider,
+				Detail: fmt.Sprintf("%s %s: %s", r.Method, r.URL.Path, helper.ProblemLoginMismatch)})
+			return principal{}, helper.NewProblemError(http.StatusForbidden, helper.ProblemLoginMismatch,
+				fmt.Sprintf("The token doesn't allow to modify the public keys of %s.", login), err)
+		}
+	}
+	return actor, nil
+}
+
+// tokenIdentity returns the login and the provider claims of the token
+func tokenIdentity(token *jwt.Token) (login, provider string) {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", ""
+	}
+	login, _ = claims["login"].(string)
+	provider, _ = claims["provider"].(string)
+	return login, provider
+}
+
+// encodeKey returns the record of a public key in the key store
+func encodeKey(key storedKey) ([]byte, error) {
+	return json.Marshal(key)
+}
+
+// decodeKey reads the record of a public key, the keys stored as raw strings before the types
+// were checked are returned with the legacy type
+func decodeKey(value []byte) storedKey {
+	var key storedKey
+	if err := json.Unmarshal(value, &key); err == nil && key.Type != "" && key.PK != "" {
+		return key
+	}
+	return storedKey{Key: keys.Legacy(string(value))}
+}
+
+// invalidKeyProblem reports a key that doesn't parse as its declared type
+func invalidKeyProblem(err error) error {
+	return helper.NewProblemError(http.StatusBadRequest, helper.ProblemInvalidKey, err.Error(), err)
+}
+
+// validKeyName tells whether name can be a login or a device ID: the internal records of the key store
+// start with "!" and the record of the public key of a device is keyed by login:device
+func validKeyName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, "!") && !strings.Contains(name, ":")
+}
+
+// checkKeyNames returns an invalid-name problem when the login or one of the device IDs can't be used
+func checkKeyNames(login string, devices ...string) error {
+	for _, name := range append([]string{login}, devices...) {
+		if !validKeyName(name) {
+			return helper.NewProblemError(http.StatusBadRequest, helper.ProblemInvalidName,
+				fmt.Sprintf("%q can't be used as a login or a device ID, it must not be empty, start with \"!\" or contain \":\".", name), nil)
 		}
 	}
 	return nil
 }
 
-func validateLogin(login string, tokenLogin string) error {
-	if login == tokenLogin {
+// validateLogin checks that the login of the request is the one of the token, the GitHub logins
+// are also known with the @github suffix
+func validateLogin(login string, actor principal) error {
+	if login == actor.Login {
 		return nil
-	} else if login == fmt.Sprintf("%s@github", tokenLogin) {
+	} else if actor.Provider == "github" && login == fmt.Sprintf("%s@github", actor.Login) {
 		return nil
 	}
 
-	return fmt.Errorf("Difference between connected login and login in the API request\nLogin : %s\nLogin in request : %s", tokenLogin, login)
+	return fmt.Errorf("Difference between connected login and login in the API request\nLogin : %s\nLogin in request : %s", actor.Login, login)
+}
+
+// storeOutcome returns the outcome of a key store operation for the metrics
+func storeOutcome(err error) string {
+	switch err {
+	case nil:
+		return metrics.OutcomeOK
+	case badger.ErrKeyNotFound:
+		return metrics.OutcomeNotFound
+	default:
+		return metrics.OutcomeError
+	}
 }
@@ -0,0 +1,130 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/keys"
+	"github.com/dgraph-io/badger"
+)
+
+func TestAddPublicKeyConcurrently(t *testing.T) {
+	db := openTestDB(t)
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest("POST", "/public-key", nil)
+			_, errs[i] = handleAddPublicKey(r, db, "alice", "alice", "phone", storedKey{Key: keys.Legacy("pk")}, nil)
+		}(i)
+	}
+	wg.Wait()
+	added := 0
+	for _, err := range errs {
+		switch err.(type) {
+		case nil:
+			added++
+		case *pkAlreadyExistsError:
+		default:
+			if err != badger.ErrConflict {
+				t.Errorf("unexpected error %v", err)
+			}
+		}
+	}
+	if added != 1 {
+		t.Errorf("the key was added %d times, want once", added)
+	}
+	var devices []string
+	db.View(func(txn *badger.Txn) (err error) {
+		devices, err = readDeviceList(txn, "alice")
+		return err
+	})
+	if len(devices) != 1 || devices[0] != "phone" {
+		t.Errorf("device list %v, want [phone]", devices)
+	}
+}
+
+func TestAddPublicKeyPreconditions(t *testing.T) {
+	tests := []struct {
+		name        string
+		existing    bool
+		ifNoneMatch string
+		wantProblem string
+	}{
+		{"new device", false, "", ""},
+		{"new device with If-None-Match", false, "*", ""},
+		{"existing device", true, "", helper.ProblemPKAlreadyExists},
+		{"existing device with If-None-Match", true, "*", helper.ProblemPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t)
+			if tt.existing {
+				if _, err := handleAddPublicKey(httptest.NewRequest("POST", "/public-key", nil), db, "alice", "alice", "phone", storedKey{Key: keys.Legacy("old")}, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r := httptest.NewRequest("POST", "/public-key", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			_, err := handleAddPublicKey(r, db, "alice", "alice", "phone", storedKey{Key: keys.Legacy("new")}, nil)
+			got := ""
+			switch e := err.(type) {
+			case nil:
+			case *pkAlreadyExistsError:
+				got = helper.ProblemPKAlreadyExists
+			case *helper.ProblemError:
+				got = e.Type
+			default:
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got != tt.wantProblem {
+				t.Errorf("problem %q, want %q", got, tt.wantProblem)
+			}
+		})
+	}
+}
+
+func TestReadStoredKeyRefusesInternalRecords(t *testing.T) {
+	db := openTestDB(t)
+	err := db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(challengeKey("alice", "laptop"), []byte(`{"type":"x25519","nonce":"n"}`)); err != nil {
+			return err
+		}
+		return txn.Set(masterKeyKey("alice"), []byte(`{"type":"ed25519","pk":"pk"}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct{ login, device string }{
+		{"!challenge", "alice:laptop"},
+		{"!master", "alice"},
+	}
+	for _, tt := range tests {
+		if _, err := handleGetPublicKey(db, tt.login, tt.device); err != badger.ErrKeyNotFound {
+			t.Errorf("handleGetPublicKey(%q, %q) error = %v, want not found", tt.login, tt.device, err)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/dgraph-io/badger"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// blockedLogin is the record of a login blocked by an admin
+type blockedLogin struct {
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason,omitempty"`
+	Actor  string    `json:"actor"`
+}
+
+func revokedTokenKey(jti string) []byte {
+	return []byte(fmt.Sprintf("!revoked:%s", jti))
+}
+
+// revokedBeforeKey is the key of the time before which the tokens of a login are revoked
+func revokedBeforeKey(login string) []byte {
+	return []byte(fmt.Sprintf("!revoked-before:%s", login))
+}
+
+func blockedLoginKey(login string) []byte {
+	return []byte(fmt.Sprintf("!blocked:%s", login))
+}
+
+// readBlockedLogin returns the block of a login, nil if it isn't blocked
+func readBlockedLogin(txn *badger.Txn, login string) (*blockedLogin, error) {
+	item, err := txn.Get(blockedLoginKey(login))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	var block blockedLogin
+	if err = json.Unmarshal(value, &block); err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+// readRevokedBefore returns the time before which the tokens of a login are revoked, zero if none is
+func readRevokedBefore(txn *badger.Txn, login string) (time.Time, error) {
+	item, err := txn.Get(revokedBeforeKey(login))
+	if err == badger.ErrKeyNotFound {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, string(value))
+}
+
+// loginAliases returns the names the blocks and the revocations of a token login are recorded under:
+// a github login is stored with its suffix, see validateLogin
+func loginAliases(login string) []string {
+	if login == "" {
+		return nil
+	}
+	login = strings.TrimSuffix(login, "@github")
+	return []string{login, login + "@github"}
+}
+
+// claimTime returns a numeric date claim, which is a float64 once parsed and an int64 when set by the server
+func claimTime(claims jwt.MapClaims, name string) (time.Time, bool) {
+	switch v := claims[name].(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case int64:
+		return time.Unix(v, 0), true
+	case json.Number:
+		n, err := v.Int64()
+		return time.Unix(n, 0), err == nil
+	}
+	return time.Time{}, false
+}
+
+// MakeTokenCheck returns the check of the tokens against the revocations and the blocked logins, for helper.SetTokenCheck
+func MakeTokenCheck(db *badger.DB) func(token *jwt.Token) error {
+	return func(token *jwt.Token) error {
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if !ok {
+			return nil
+		}
+		login, _ := tokenIdentity(token)
+		aliases := loginAliases(login)
+		jti, _ := claims["jti"].(string)
+		var problem *helper.ProblemError
+		err := db.View(func(txn *badger.Txn) error {
+			for _, l := range aliases {
+				block, err := readBlockedLogin(txn, l)
+				if err != nil {
+					return err
+				} else if block != nil {
+					problem = helper.NewProblemError(http.StatusForbidden, helper.ProblemLoginBlocked,
+						fmt.Sprintf("The login %s is blocked since %s.", l, block.Since.Format(time.RFC3339)), nil)
+					return nil
+				}
+			}
+			if jti != "" {
+				_, err := txn.Get(revokedTokenKey(jti))
+				if err == nil {
+					problem = helper.NewProblemError(http.StatusUnauthorized, helper.ProblemTokenRevoked, "The token has been revoked.", nil)
+					return nil
+				} else if err != badger.ErrKeyNotFound {
+					return err
+				}
+			}
+			for _, l := range aliases {
+				before, err := readRevokedBefore(txn, l)
+				if err != nil {
+					return err
+				} else if before.IsZero() {
+					continue
+				}
+				// a token without issue time can't be told apart from the revoked ones
+				if iat, ok := claimTime(claims, "iat"); !ok || iat.Before(before) {
+					problem = helper.NewProblemError(http.StatusUnauthorized, helper.ProblemTokenRevoked,
+						fmt.Sprintf("The tokens of %s issued before %s have been revoked.", l, before.Format(time.RFC3339)), nil)
+					return nil
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return helper.NewProblemError(http.StatusInternalServerError, helper.ProblemInternalError, "Couldn't check the revocation of the token.", err)
+		}
+		if problem != nil {
+			return problem
+		}
+		return nil
+	}
+}
+
+// revokeToken revokes a token by its ID until it expires, or for ttl if it has no expiry known
+func revokeToken(db *badger.DB, jti string, ttl time.Duration) error {
+	value := []byte(time.Now().UTC().Format(time.RFC3339))
+	return db.Update(func(txn *badger.Txn) error {
+		if ttl > 0 {
+			return txn.SetWithTTL(revokedTokenKey(jti), value, ttl)
+		}
+		return txn.Set(revokedTokenKey(jti), value)
+	})
+}
+
+// revokeLoginTokens revokes all the tokens of a login issued before now
+func revokeLoginTokens(db *badger.DB, login string, now time.Time) error {
+	return db.Update(func(txn *badger.Txn) error {
+		// the issue times have a one second precision
+		return txn.Set(revokedBeforeKey(login), []byte(now.UTC().Add(time.Second).Truncate(time.Second).Format(time.RFC3339)))
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/dgraph-io/badger"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestTokenCheck(t *testing.T) {
+	// the tokens of a revoked login are revoked up to the next second
+	revokedAt := time.Date(2026, 10, 19, 12, 0, 0, 500000000, time.UTC)
+	cutoff := time.Date(2026, 10, 19, 12, 0, 1, 0, time.UTC)
+	tests := []struct {
+		name        string
+		revoked     string // login whose tokens are revoked
+		blocked     string
+		revokedJTI  string
+		login       string
+		jti         string
+		iat         interface{}
+		wantProblem string
+	}{
+		{"not revoked", "", "", "", "alice", "", cutoff.Add(-time.Hour).Unix(), ""},
+		{"issued before the cutoff", "alice", "", "", "alice", "", cutoff.Add(-time.Second).Unix(), helper.ProblemTokenRevoked},
+		{"issued at the cutoff", "alice", "", "", "alice", "", cutoff.Unix(), ""},
+		{"issued time parsed from JSON", "alice", "", "", "alice", "", float64(cutoff.Add(-time.Second).Unix()), helper.ProblemTokenRevoked},
+		{"no issue time", "alice", "", "", "alice", "", nil, helper.ProblemTokenRevoked},
+		{"github alias revoked", "alice@github", "", "", "alice", "", cutoff.Add(-time.Second).Unix(), helper.ProblemTokenRevoked},
+		{"github login revoked by its plain name", "alice", "", "", "alice@github", "", cutoff.Add(-time.Second).Unix(), helper.ProblemTokenRevoked},
+		{"other login revoked", "bob", "", "", "alice", "", cutoff.Add(-time.Second).Unix(), ""},
+		{"github alias blocked", "", "alice@github", "", "alice", "", cutoff.Unix(), helper.ProblemLoginBlocked},
+		{"token ID revoked", "", "", "t1", "alice", "t1", cutoff.Unix(), helper.ProblemTokenRevoked},
+		{"other token ID revoked", "", "", "t1", "alice", "t2", cutoff.Unix(), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t)
+			if tt.revoked != "" {
+				if err := revokeLoginTokens(db, tt.revoked, revokedAt); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.revokedJTI != "" {
+				if err := revokeToken(db, tt.revokedJTI, time.Hour); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.blocked != "" {
+				err := db.Update(func(txn *badger.Txn) error {
+					value, err := json.Marshal(blockedLogin{Since: revokedAt, Actor: "admin"})
+					if err != nil {
+						return err
+					}
+					return txn.Set(blockedLoginKey(tt.blocked), value)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			claims := jwt.MapClaims{"login": tt.login}
+			if tt.jti != "" {
+				claims["jti"] = tt.jti
+			}
+			if tt.iat != nil {
+				claims["iat"] = tt.iat
+			}
+			err := MakeTokenCheck(db)(jwt.NewWithClaims(jwt.SigningMethodHS256, claims))
+			got := ""
+			if err != nil {
+				problem, ok := err.(*helper.ProblemError)
+				if !ok {
+					t.Fatalf("unexpected error %v", err)
+				}
+				got = problem.Type
+			}
+			if got != tt.wantProblem {
+				t.Errorf("problem %q, want %q", got, tt.wantProblem)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/coast-team/mute-auth-proxy/audit"
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/coast-team/mute-auth-proxy/metrics"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// principal is the client authenticated by the Authorizer
+type principal struct {
+	Login    string
+	Provider string // the provider of its token, mtls for a client certificate
+	Roles    []string
+}
+
+type principalKey struct{}
+
+// requestPrincipal returns the client let through by the Authorizer
+func requestPrincipal(r *http.Request) principal {
+	p, _ := r.Context().Value(principalKey{}).(principal)
+	return p
+}
+
+// Authorizer enforces the roles required by the routes of a listener
+type Authorizer struct {
+	certRole string
+}
+
+// NewAuthorizer returns the authorizer of a listener, certRole is the role of the clients authenticated
+// by a certificate verified by the listener
+func NewAuthorizer(certRole string) *Authorizer {
+	return &Authorizer{certRole: certRole}
+}
+
+// Require returns the middleware letting through the requests authenticated with one of the roles.
+// The denials are answered with a problem and recorded in the audit log.
+func (a *Authorizer) Require(roles ...string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			p, err := a.authenticate(r)
+			if err == nil && !hasAnyRole(p.Roles, roles) {
+				metrics.JWTValidationFailure("role")
+				err = helper.NewProblemError(http.StatusForbidden, helper.ProblemInsufficientRole,
+					fmt.Sprintf("The route requires one of the roles %s.", strings.Join(roles, ", ")), nil)
+			}
+			if err != nil {
+				audit.Record(r, audit.Entry{Event: audit.EventAccessDenied, Login: mux.Vars(r)["login"], Actor: p.Login, Provider: p.Provider,
+					Detail: fmt.Sprintf("%s %s: %s", r.Method, r.URL.Path, err.(*helper.ProblemError).Type)})
+				helper.WriteError(w, err)
+				logging.FromRequest(r).WithError(err).Warn("Authorization failed")
+				return
+			}
+			logging.AddFields(r, logrus.Fields{"actor": p.Login})
+			h(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+		}
+	}
+}
+
+// authenticate returns the client of the request, identified by its certificate when it doesn't give a token.
+// The returned errors are *helper.ProblemError, the principal is set when the token is valid.
+func (a *Authorizer) authenticate(r *http.Request) (principal, error) {
+	token, err := helper.Authenticate(r)
+	if err != nil {
+		return principal{}, helper.TokenProblem(helper.IsJWTValid(token, err))
+	}
+	login, provider := tokenIdentity(token)
+	p := principal{Login: login, Provider: provider, Roles: helper.TokenRoles(token)}
+	if claims, ok := token.Claims.(jwt.MapClaims); ok && claims["auth"] == "mtls" {
+		p.Provider, p.Roles = "mtls", []string{a.certRole}
+	}
+	// the common name of a certificate can be blocked like the login of a token
+	if err = helper.CheckToken(token); err != nil {
+		metrics.JWTValidationFailure("revoked")
+		return p, err
+	}
+	return p, nil
+}
+
+func hasAnyRole(granted, required []string) bool {
+	for _, role := range required {
+		if helper.StringInSlice(role, granted) {
+			return true
+		}
+	}
+	return false
+}
@@ -12,27 +12,42 @@ mkdir -p /tmp/test_pk_api/
 
 baseUrl="http://localhost:4000"
 
+# The keys are Ed25519 keys made by openssl, adding or updating one needs a signed challenge (see the README)
+newKey() {
+    openssl genpkey -algorithm ed25519 -out "/tmp/test_pk_api/$1.pem"
+    openssl pkey -in "/tmp/test_pk_api/$1.pem" -pubout -outform DER | tail -c 32 | base64
+}
+
+# proof <login> <device> <key> prints the challenge and the signature members of the request body
+proof() {
+    challenge=$(curl -s "$baseUrl/public-key/challenge" -d '{"login":"'"$1"'","deviceID":"'"$2"'","type":"ed25519"}' -H "Content-Type: application/json" -H "authorization: Bearer $token" | sed 's/.*"challenge":"\([^"]*\)".*/\1/')
+    printf 'mute-auth-proxy challenge v1\n%s\n%s\n%s' "$1" "$2" "$challenge" > /tmp/test_pk_api/message
+    signature=$(openssl pkeyutl -sign -rawin -inkey "/tmp/test_pk_api/$3.pem" -in /tmp/test_pk_api/message | base64 | tr -d '\n')
+    printf '"challenge":"%s","signature":"%s"' "$challenge" "$signature"
+}
+token="$1"
+
 
 echo -e "=========== Begin Test 1 ===========\nTry to add the PK of someone else than you (given the JWT that identifies yourself)\n"
 loginWrong="Alice"
 deviceWrong="device1"
-pkWrong="pk1"
-curl "$baseUrl/public-key" -d '{"login":"'"$loginWrong"'","device":"'"$deviceWrong"'","pk":"'"$pkWrong"'"}' -H "Content-Type: application/json" -H "authorization: Bearer $1" -i
-echo -e "\n=========== End Test 1 ===========\nResponse should be HTTP error 401 Unauthorized\n\n"
+pkWrong=$(newKey wrong)
+curl "$baseUrl/public-key" -d '{"login":"'"$loginWrong"'","deviceID":"'"$deviceWrong"'","type":"ed25519","pk":"'"$pkWrong"'"}' -H "Content-Type: application/json" -H "authorization: Bearer $1" -i
+echo -e "\n=========== End Test 1 ===========\nResponse should be HTTP error 403 Forbidden with a login-mismatch problem\n\n"
 
 loginJP="jpeisenbarth"
 deviceJP1="device1"
 deviceJP2="device2"
-pkJP1="pk1"
-pkJP2="pk2"
+pkJP1=$(newKey jp1)
+pkJP2=$(newKey jp2)
 echo -e "=========== Begin Test 2 ===========\nTry to add PK ($pkJP1, $pkJP2) for $loginJP-$deviceJP1 and $loginJP-$deviceJP2\n"
-curl "$baseUrl/public-key" -d '{"login":"'"$loginJP"'","device":"'"$deviceJP1"'","pk":"'"$pkJP1"'"}' -H "Content-Type: application/json" -H "authorization: Bearer $1" -i
-curl "$baseUrl/public-key" -d '{"login":"'"$loginJP"'","device":"'"$deviceJP2"'","pk":"'"$pkJP2"'"}' -H "Content-Type: application/json" -H "authorization: Bearer $1" -i
+curl "$baseUrl/public-key" -d '{"login":"'"$loginJP"'","deviceID":"'"$deviceJP1"'","type":"ed25519","pk":"'"$pkJP1"'",'"$(proof $loginJP $deviceJP1 jp1)"'}' -H "Content-Type: application/json" -H "authorization: Bearer $1" -i
+curl "$baseUrl/public-key" -d '{"login":"'"$loginJP"'","deviceID":"'"$deviceJP2"'","type":"ed25519","pk":"'"$pkJP2"'",'"$(proof $loginJP $deviceJP2 jp2)"'}' -H "Content-Type: application/json" -H "authorization: Bearer $1" -i
 echo -e "\n=========== End Test 2 ===========\nResponse should be HTTP error 201 Created and the summary of the add operation in the body (as JSON)\n\n"
 
 echo -e "=========== Begin Test 3 ===========\nTry to add again a PK ($pkJP1) for the same login and device than before ($loginJP-$deviceJP1)\n"
-curl "$baseUrl/public-key" -d '{"login":"'"$loginJP"'","device":"'"$deviceJP1"'","pk":"'"$pkJP1"'"}' -H "Content-Type: application/json" -H "authorization: Bearer $1" -i
-echo -e "\n=========== End Test 3 ===========\nResponse should be HTTP error 400 Bad Request\n\n"
+curl "$baseUrl/public-key" -d '{"login":"'"$loginJP"'","deviceID":"'"$deviceJP1"'","type":"ed25519","pk":"'"$pkJP1"'",'"$(proof $loginJP $deviceJP1 jp1)"'}' -H "Content-Type: application/json" -H "authorization: Bearer $1" -i
+echo -e "\n=========== End Test 3 ===========\nResponse should be HTTP error 409 Conflict\n\n"
 
 echo -e "=========== Begin Test 4 ===========\nTry to get the PK of $loginJP-$deviceJP1\n"
 curl "$baseUrl/public-key/$loginJP/$deviceJP1"  -H "authorization: Bearer $1" -i
@@ -48,10 +63,10 @@ echo -e "\n=========== End Test 6 ===========\nResponse should be HTTP error 200
 
 echo -e "=========== Begin Test 7 ===========\nTry to get all the PK of $loginWrong\n"
 curl "$baseUrl/public-key/$loginWrong"  -H "authorization: Bearer $1" -i
-echo -e "\n=========== End Test 7 ===========\nResponse should be HTTP error 401 Unauthorized\n\n"
+echo -e "\n=========== End Test 7 ===========\nResponse should be HTTP error 403 Forbidden with a login-mismatch problem\n\n"
 
-pkJP3="pk3"
+pkJP3=$(newKey jp3)
 echo -e "=========== Begin Test 8 ===========\nTry to update the PK of $loginJP\n"
-curl "$baseUrl/public-key/$loginJP/$deviceJP1" -X PUT -d '{"pk": "'"$pkJP3"'"}' -H "Content-Type: application/json" -H "authorization: Bearer $1" -i
+curl "$baseUrl/public-key/$loginJP/$deviceJP1" -X PUT -d '{"type": "ed25519", "pk": "'"$pkJP3"'",'"$(proof $loginJP $deviceJP1 jp3)"'}' -H "Content-Type: application/json" -H "authorization: Bearer $1" -i
 curl "$baseUrl/public-key/$loginJP"  -H "authorization: Bearer $1" -i
-echo -e "\n=========== End Test 8 ===========\nResponse should be HTTP error 200 OK followed by HTTP error 200 OK with PK in response body (as JSON) \n\n"
\ No newline at end of file
+echo -e "\n=========== End Test 8 ===========\nResponse should be HTTP error 200 OK followed by HTTP error 200 OK with PK in response body (as JSON) \n\n"
@@ -0,0 +1,255 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package audit keeps an append-only log of the security-relevant events (logins, token issuance,
+// key changes and authorization denials). Each entry is hash-chained to the previous one, so that
+// a modified or removed entry breaks the chain.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/logging"
+)
+
+// The audited events
+const (
+	EventLogin            = "login"
+	EventLoginFailed      = "login_failed"
+	EventTokenIssued      = "token_issued"
+	EventKeyAdded         = "key_added"
+	EventKeyUpdated       = "key_updated"
+	EventKeyDeleted       = "key_deleted"
+	EventKeyExpired       = "key_expired"
+	EventMasterKeySet     = "master_key_set"
+	EventPrekeysPublished = "prekeys_published"
+	EventAccessDenied     = "access_denied"
+	EventTokenRevoked     = "token_revoked"
+	EventLoginBlocked     = "login_blocked"
+	EventLoginUnblocked   = "login_unblocked"
+)
+
+// Events lists the audited events
+var Events = []string{EventLogin, EventLoginFailed, EventTokenIssued, EventKeyAdded, EventKeyUpdated, EventKeyDeleted,
+	EventKeyExpired, EventMasterKeySet, EventPrekeysPublished, EventAccessDenied, EventTokenRevoked, EventLoginBlocked, EventLoginUnblocked}
+
+// tailSize is the size of the end of the file read to find the last entry
+const tailSize = 64 * 1024
+
+// Entry is an audit log entry. Hash is the SHA-256 of Prev and of the entry without its hash.
+type Entry struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Login     string    `json:"login,omitempty"`    // the login the event is about
+	Device    string    `json:"device,omitempty"`   // the device, for the key events
+	Actor     string    `json:"actor,omitempty"`    // the authenticated login that triggered the event
+	Provider  string    `json:"provider,omitempty"` // google, github, client, bot or cli
+	RequestID string    `json:"request_id,omitempty"`
+	Remote    string    `json:"remote,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	Prev      string    `json:"prev"`
+	Hash      string    `json:"hash,omitempty"`
+}
+
+// computeHash returns the hash chaining the entry to the previous one
+func (e Entry) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(e.Prev+"\n"), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Log is an audit log file. Several processes (the server and the generate-jwt command) can append
+// to the same file, the appends are serialized with a file lock.
+type Log struct {
+	mu   sync.Mutex
+	file *os.File
+	last Entry // last entry of the file, zero if empty
+	size int64 // size of the file when last was read
+}
+
+// Open opens or creates the audit log file
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't open the audit log: %v", err)
+	}
+	return &Log{file: file, size: -1}, nil
+}
+
+// Close closes the audit log file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Append sets the sequence number, the time and the hashes of the entry, then writes it
+func (l *Log) Append(e Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fd := int(l.file.Fd())
+	if err := syscall.Flock(fd, syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(fd, syscall.LOCK_UN)
+
+	info, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size != l.size {
+		// another process has appended entries, or a crash interrupted the last one
+		if size, err = truncatePartial(l.file, size); err != nil {
+			return err
+		}
+		if l.last, err = readLast(l.file, size); err != nil {
+			return err
+		}
+	}
+	e.Seq = l.last.Seq + 1
+	e.Time = time.Now().UTC()
+	e.Prev = l.last.Hash
+	if e.Hash, err = e.computeHash(); err != nil {
+		return err
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	n, err := l.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	if err = l.file.Sync(); err != nil {
+		return err
+	}
+	l.last = e
+	l.size = size + int64(n)
+	return nil
+}
+
+// truncatePartial removes the end of an entry whose write was interrupted, after the last newline of the file,
+// so that the next entry starts a line and follows the last complete one. It returns the new size of the file.
+func truncatePartial(file *os.File, size int64) (int64, error) {
+	offset := size - tailSize
+	if offset < 0 {
+		offset = 0
+	}
+	tail := make([]byte, size-offset)
+	if _, err := file.ReadAt(tail, offset); err != nil {
+		return size, err
+	}
+	end := bytes.LastIndexByte(tail, '\n') + 1
+	if end == len(tail) {
+		return size, nil
+	}
+	if end == 0 && offset > 0 {
+		return size, fmt.Errorf("Couldn't find the end of the last audit log entry in the last %d bytes", tailSize)
+	}
+	logging.Log.WithField("bytes", len(tail)-end).Warn("Truncating the partial last entry of the audit log")
+	return offset + int64(end), file.Truncate(offset + int64(end))
+}
+
+// readLast returns the last entry of the file, or a zero entry if it is empty
+func readLast(file *os.File, size int64) (Entry, error) {
+	var last Entry
+	offset := size - tailSize
+	if offset < 0 {
+		offset = 0
+	}
+	scanner := bufio.NewScanner(io.NewSectionReader(file, offset, size-offset))
+	scanner.Buffer(make([]byte, tailSize), tailSize)
+	var line []byte
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			line = append(line[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return last, err
+	}
+	if line == nil {
+		return last, nil
+	}
+	if err := json.Unmarshal(line, &last); err != nil {
+		return last, fmt.Errorf("Couldn't read the last audit log entry: %v", err)
+	}
+	return last, nil
+}
+
+var (
+	defaultMu       sync.RWMutex
+	defaultLog      *Log
+	defaultObserver func(Entry)
+)
+
+// SetLog sets the audit log used by Record, nil disables the audit
+func SetLog(l *Log) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultLog = l
+}
+
+// SetObserver sets the function notified of the recorded events, even when the audit is disabled. nil removes it.
+func SetObserver(observer func(Entry)) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultObserver = observer
+}
+
+// Record appends an event to the audit log, with the ID and the remote address of the request if r is not nil.
+// A failure is logged but doesn't fail the request.
+func Record(r *http.Request, e Entry) {
+	defaultMu.RLock()
+	l, observer := defaultLog, defaultObserver
+	defaultMu.RUnlock()
+	if l == nil && observer == nil {
+		return
+	}
+	entry := logging.Log.WithField("event", e.Event)
+	if r != nil {
+		e.RequestID = r.Header.Get(logging.RequestIDHeader)
+		e.Remote = r.RemoteAddr
+		entry = logging.FromRequest(r).WithField("event", e.Event)
+	}
+	if l != nil {
+		if err := l.Append(e); err != nil {
+			entry.WithError(err).Error("Couldn't write the audit log entry")
+		}
+	}
+	if observer != nil {
+		e.Time = time.Now().UTC()
+		observer(e)
+	}
+}
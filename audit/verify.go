@@ -0,0 +1,121 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// maxLineSize is the maximal size of an audit log line
+const maxLineSize = 1024 * 1024
+
+// ChainError reports the first entry breaking the hash chain
+type ChainError struct {
+	Line   int
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("audit log chain broken at line %d: %s", e.Line, e.Reason)
+}
+
+// Filter selects audit log entries, the zero values match everything
+type Filter struct {
+	Login string // matches the login or the actor
+	Event string
+	Since time.Time
+	Until time.Time
+}
+
+// Match returns true if the entry is selected by the filter
+func (f Filter) Match(e Entry) bool {
+	if f.Login != "" && e.Login != f.Login && e.Actor != f.Login {
+		return false
+	}
+	if f.Event != "" && e.Event != f.Event {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Verify reads the whole audit log and checks the sequence numbers and the hash chain.
+// It returns the number of entries, and a ChainError for the first broken entry.
+func Verify(r io.Reader) (int, error) {
+	count := 0
+	err := scan(r, func(line int, e Entry, prev Entry) error {
+		if e.Seq != prev.Seq+1 {
+			return &ChainError{line, fmt.Sprintf("sequence number %d follows %d", e.Seq, prev.Seq)}
+		}
+		if e.Prev != prev.Hash {
+			return &ChainError{line, "the previous hash doesn't match the previous entry"}
+		}
+		hash, err := e.computeHash()
+		if err != nil {
+			return err
+		}
+		if hash != e.Hash {
+			return &ChainError{line, "the entry has been modified"}
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// Read calls fn for each entry of the audit log matched by the filter
+func Read(r io.Reader, filter Filter, fn func(Entry) error) error {
+	return scan(r, func(line int, e Entry, prev Entry) error {
+		if filter.Match(e) {
+			return fn(e)
+		}
+		return nil
+	})
+}
+
+// scan decodes the entries of the audit log and calls fn with each entry and the previous one
+func scan(r io.Reader, fn func(line int, e Entry, prev Entry) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	var prev Entry
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return &ChainError{line, fmt.Sprintf("malformed entry: %v", err)}
+		}
+		if err := fn(line, e, prev); err != nil {
+			return err
+		}
+		prev = e
+	}
+	return scanner.Err()
+}
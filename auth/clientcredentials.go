@@ -0,0 +1,196 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/audit"
+	"github.com/coast-team/mute-auth-proxy/config"
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/coast-team/mute-auth-proxy/metrics"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ClientCredentialsGrant is the only grant type supported by the token route
+const ClientCredentialsGrant = "client_credentials"
+
+// ClientToken represents the successful response of the token route (RFC 6749 section 5.1)
+type ClientToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+// tokenError represents an error response of the token route (RFC 6749 section 5.2)
+type tokenError struct {
+	status      int
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *tokenError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+// MakeTokenHandler returns the handler for the token route used by the services (bots) to get a short-lived JWT
+func MakeTokenHandler(conf *config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logging.AddFields(r, logrus.Fields{"provider": "client"})
+		err := handleClientCredentials(w, r, conf)
+		if err != nil {
+			outcome := "token_failed"
+			if tErr, ok := err.(*tokenError); ok {
+				writeTokenError(w, tErr)
+				outcome = tErr.Code
+			}
+			metrics.OAuthExchange("client", outcome)
+			if outcome == "invalid_client" {
+				clientID, _, ok := r.BasicAuth()
+				if !ok {
+					clientID = r.PostForm.Get("client_id")
+				}
+				audit.Record(r, audit.Entry{Event: audit.EventLoginFailed, Login: clientID, Provider: "client", Detail: outcome})
+			}
+			logging.FromRequest(r).WithError(err).Warn("Client credentials grant failed")
+			return
+		}
+		metrics.OAuthExchange("client", "success")
+	}
+}
+
+func handleClientCredentials(w http.ResponseWriter, r *http.Request, conf *config.Config) error {
+	if err := helper.ParseForm(w, r, int64(conf.BodyLimits.Auth)); err != nil {
+		status := http.StatusBadRequest
+		if bodyErr, ok := err.(*helper.BodyError); ok {
+			status = bodyErr.Status
+		}
+		return &tokenError{status, "invalid_request", "Couldn't parse the request's body."}
+	}
+	if grantType := r.PostForm.Get("grant_type"); grantType != ClientCredentialsGrant {
+		return &tokenError{http.StatusBadRequest, "unsupported_grant_type", fmt.Sprintf("Grant type '%s' is not supported.", grantType)}
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+	logging.AddFields(r, logrus.Fields{"login": clientID})
+	client, err := authenticateClient(conf.OauthPrefs.Clients, clientID, clientSecret)
+	if err != nil {
+		return err
+	}
+
+	scopes, err := grantedScopes(client, r.PostForm.Get("scope"))
+	if err != nil {
+		return err
+	}
+
+	ttl := conf.OauthPrefs.ClientTokenTTL.Duration
+	token := helper.GenerateJWT()
+	claims := token.Claims.(jwt.MapClaims)
+	setClientClaims(claims, client.ID, scopes, ttl)
+	SetRoles(claims, grantedRoles(conf.Roles.Rules, helper.RoleBot, clientLogin(client.ID), nil, ""))
+	if err = helper.CheckToken(token); err != nil {
+		return &tokenError{http.StatusBadRequest, "unauthorized_client", fmt.Sprintf("The client '%s' is blocked.", client.ID)}
+	}
+	signedString, err := helper.GetSignedString(token)
+	if err != nil {
+		writeTokenError(w, &tokenError{http.StatusInternalServerError, "server_error", "Failed to generate the token."})
+		return fmt.Errorf("Failed to generate a JWT token.\nError was: %s", err)
+	}
+
+	audit.Record(r, audit.Entry{Event: audit.EventTokenIssued, Login: clientLogin(client.ID), Provider: "client",
+		Detail: fmt.Sprintf("scope %q, %s", strings.Join(scopes, " "), TokenDetail(claims))})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(ClientToken{
+		AccessToken: signedString,
+		TokenType:   "bearer",
+		ExpiresIn:   int64(ttl.Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	})
+}
+
+// authenticateClient looks for the registered client and checks its secret against the stored bcrypt hash
+func authenticateClient(clients []config.ServiceClient, clientID, clientSecret string) (*config.ServiceClient, error) {
+	if clientID == "" || clientSecret == "" {
+		return nil, &tokenError{http.StatusUnauthorized, "invalid_client", "Client credentials are missing."}
+	}
+	for i := range clients {
+		if clients[i].ID != clientID {
+			continue
+		}
+		err := bcrypt.CompareHashAndPassword([]byte(clients[i].SecretHash), []byte(clientSecret))
+		if err != nil {
+			break
+		}
+		return &clients[i], nil
+	}
+	return nil, &tokenError{http.StatusUnauthorized, "invalid_client", fmt.Sprintf("Client authentication failed for '%s'.", clientID)}
+}
+
+// grantedScopes returns the requested scopes, or all the allowed scopes of the client if none were requested
+func grantedScopes(client *config.ServiceClient, requested string) ([]string, error) {
+	if requested == "" {
+		return client.Scopes, nil
+	}
+	scopes := strings.Fields(requested)
+	for _, scope := range scopes {
+		if !helper.StringInSlice(scope, client.Scopes) {
+			return nil, &tokenError{http.StatusBadRequest, "invalid_scope", fmt.Sprintf("Scope '%s' is not allowed for this client.", scope)}
+		}
+	}
+	return scopes, nil
+}
+
+// clientLogin returns the login of the tokens of a service client, the suffix keeps the clients apart
+// from the users, whose GitHub logins have none and Google logins are email addresses
+func clientLogin(clientID string) string {
+	return clientID + "@client"
+}
+
+func setClientClaims(claims jwt.MapClaims, clientID string, scopes []string, ttl time.Duration) {
+	now := time.Now()
+	claims["provider"] = "client"
+	claims["login"] = clientLogin(clientID)
+	claims["scope"] = strings.Join(scopes, " ")
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(ttl).Unix()
+}
+
+func writeTokenError(w http.ResponseWriter, err *tokenError) {
+	if err.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mute-auth-proxy"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(err.status)
+	json.NewEncoder(w).Encode(err)
+}
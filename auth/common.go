@@ -20,12 +20,16 @@ package auth
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"time"
 
+	"github.com/coast-team/mute-auth-proxy/audit"
+	"github.com/coast-team/mute-auth-proxy/config"
 	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/coast-team/mute-auth-proxy/metrics"
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 )
 
@@ -34,14 +38,33 @@ var apiEndpoint = map[string]string{
 	"google": "https://www.googleapis.com/oauth2/v3/userinfo",
 }
 
+// requestData is the body sent by the OAuth client library of the frontend. Only its top-level object is
+// decoded strictly: the library adds provider specific parameters (scope, state...) to the nested ones.
 type requestData struct {
-	AuthorizationData struct {
-		ClientID    string `json:"client_id"`
-		RedirectURI string `json:"redirect_uri"`
-	} `json:"authorizationData"`
-	OAuthData struct {
-		Code string `json:"code"`
-	} `json:"oauthData"`
+	AuthorizationData authorizationData `json:"authorizationData"`
+	OAuthData         oauthData         `json:"oauthData"`
+	UserData          json.RawMessage   `json:"userData,omitempty"`
+}
+
+type authorizationData struct {
+	ClientID    string `json:"client_id"`
+	RedirectURI string `json:"redirect_uri"`
+}
+
+// UnmarshalJSON ignores the unknown fields
+func (d *authorizationData) UnmarshalJSON(b []byte) error {
+	type plain authorizationData
+	return json.Unmarshal(b, (*plain)(d))
+}
+
+type oauthData struct {
+	Code string `json:"code"`
+}
+
+// UnmarshalJSON ignores the unknown fields
+func (d *oauthData) UnmarshalJSON(b []byte) error {
+	type plain oauthData
+	return json.Unmarshal(b, (*plain)(d))
 }
 
 // Token respresents the structure that contains the String formatted JWT
@@ -49,50 +72,90 @@ type Token struct {
 	AccessToken string `json:"access_token"`
 }
 
-func handleProviderCallback(w http.ResponseWriter, r *http.Request, provider string, conf oauth2.Config) error {
+func handleProviderCallback(w http.ResponseWriter, r *http.Request, provider string, conf oauth2.Config, maxBody int64, rules []config.RoleRule) error {
+	logging.AddFields(r, logrus.Fields{"provider": provider})
+	outcome := "bad_request"
+	defer func() {
+		metrics.OAuthExchange(provider, outcome)
+		if outcome != "success" {
+			audit.Record(r, audit.Entry{Event: audit.EventLoginFailed, Provider: provider, Detail: outcome})
+		}
+	}()
+
 	var data requestData
-	err := json.NewDecoder(r.Body).Decode(&data)
+	err := helper.DecodeJSON(w, r, maxBody, &data)
 	if err != nil {
-		if err == io.EOF {
-			return fmt.Errorf("Couldn't decode request's body, maybe CORS issue ?\nError was: %s", err)
-		}
-		w.Write([]byte("Couldn't decode request's body."))
+		helper.WriteError(w, err)
 		return fmt.Errorf("Couldn't decode request's body.\nError was: %s", err)
 	}
 
 	conf.ClientID = data.AuthorizationData.ClientID
 	conf.RedirectURL = data.AuthorizationData.RedirectURI
 
+	outcome = "exchange_failed"
 	accessToken, err := conf.Exchange(oauth2.NoContext, data.OAuthData.Code)
 	if err != nil {
-		w.Write([]byte("Code exchange failed."))
+		if _, ok := err.(*oauth2.RetrieveError); ok {
+			helper.WriteProblem(w, helper.NewProblem(http.StatusBadRequest, helper.ProblemOAuthCodeRejected, "The authorization code couldn't be exchanged, login again."))
+		} else {
+			helper.WriteProblem(w, helper.NewProblem(http.StatusBadGateway, helper.ProblemOAuthProviderError, fmt.Sprintf("%s couldn't be reached.", provider)))
+		}
 		return fmt.Errorf("Code exchange failed.\nError was: %s", err)
 	}
 
+	outcome = "profile_failed"
 	client := conf.Client(oauth2.NoContext, accessToken)
 	client.Timeout = time.Duration(5) * time.Second
 	response, err := client.Get(apiEndpoint[provider])
 	if err != nil {
-		w.Write([]byte("Server internal error."))
+		helper.WriteProblem(w, helper.NewProblem(http.StatusBadGateway, helper.ProblemOAuthProviderError, fmt.Sprintf("The %s profile couldn't be fetched.", provider)))
 		return fmt.Errorf("People API request failed.\nError was: %s", err)
 	}
 	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		helper.WriteProblem(w, helper.NewProblem(http.StatusBadGateway, helper.ProblemOAuthProviderError, fmt.Sprintf("The %s profile couldn't be fetched.", provider)))
+		return fmt.Errorf("People API request failed with status %s", response.Status)
+	}
 
 	var profile map[string]interface{}
 	err = json.NewDecoder(response.Body).Decode(&profile)
 	if err != nil {
-		w.Write([]byte("Server internal error."))
+		helper.WriteProblem(w, helper.NewProblem(http.StatusBadGateway, helper.ProblemOAuthProviderError, fmt.Sprintf("The %s profile couldn't be decoded.", provider)))
 		return fmt.Errorf("Couldn't decode %s's response.\nError was: %s", provider, err)
 	}
 
+	outcome = "token_failed"
 	token := helper.GenerateJWT()
 	SetClaims(token, profile, provider)
+	claims := token.Claims.(jwt.MapClaims)
+	login := fmt.Sprint(claims["login"])
+	logging.AddFields(r, logrus.Fields{"login": login})
+	var githubOrgs []string
+	if provider == "github" && needsGithubOrgs(rules) {
+		if githubOrgs, err = fetchGithubOrgs(client); err != nil {
+			logging.FromRequest(r).WithError(err).Warn("Couldn't fetch the GitHub organizations, their roles aren't granted")
+		}
+	}
+	var googleDomain string
+	if provider == "google" {
+		googleDomain, _ = profile["hd"].(string)
+	}
+	SetRoles(claims, grantedRoles(rules, helper.RoleUser, login, githubOrgs, googleDomain))
+	outcome = "blocked"
+	if err = helper.CheckToken(token); err != nil {
+		helper.WriteError(w, err)
+		return fmt.Errorf("Refused to issue a JWT token.\nError was: %s", err)
+	}
+	outcome = "token_failed"
 	signedString, err := helper.GetSignedString(token)
 	if err != nil {
-		w.Write([]byte("Server internal error."))
+		helper.WriteError(w, err)
 		return fmt.Errorf("Failed to generate a JWT token.\nError was: %s", err)
 	}
 
+	outcome = "success"
+	audit.Record(r, audit.Entry{Event: audit.EventLogin, Login: login, Provider: provider})
+	audit.Record(r, audit.Entry{Event: audit.EventTokenIssued, Login: login, Provider: provider, Detail: TokenDetail(claims)})
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	jwt := Token{AccessToken: signedString}
@@ -100,6 +163,19 @@ func handleProviderCallback(w http.ResponseWriter, r *http.Request, provider str
 	return nil
 }
 
+// TokenExpiry describes the expiry of a token for the audit log
+func TokenExpiry(claims jwt.MapClaims) string {
+	if exp, ok := claims["exp"].(int64); ok && exp > 0 {
+		return fmt.Sprintf("expires %s", time.Unix(exp, 0).UTC().Format(time.RFC3339))
+	}
+	return "never expires"
+}
+
+// TokenDetail describes a token for the audit log: its ID, to revoke it, its roles and its expiry
+func TokenDetail(claims jwt.MapClaims) string {
+	return fmt.Sprintf("jti %v, roles %q, %s", claims["jti"], claims[helper.RolesClaim], TokenExpiry(claims))
+}
+
 // SetClaims sets the different claims to a JWT depending on the service (Google, Github, botstorage)
 func SetClaims(token *jwt.Token, profile map[string]interface{}, provider string) {
 	claims := token.Claims.(jwt.MapClaims)
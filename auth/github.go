@@ -18,11 +18,11 @@
 package auth
 
 import (
-	"log"
 	"net/http"
 	"time"
 
 	"github.com/coast-team/mute-auth-proxy/config"
+	"github.com/coast-team/mute-auth-proxy/logging"
 	jwt "github.com/dgrijalva/jwt-go"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/github"
@@ -32,12 +32,12 @@ import (
 func MakeGithubLoginHandler(conf *config.Config) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		githubOauthConfig := oauth2.Config{
-			ClientSecret: conf.OauthPrefs.GithubPrefs.ClientSecret,
+			ClientSecret: conf.OauthPrefs.GithubPrefs.ClientSecret.Value(),
 			Endpoint:     github.Endpoint,
 		}
-		err := handleProviderCallback(w, r, "github", githubOauthConfig)
+		err := handleProviderCallback(w, r, "github", githubOauthConfig, int64(conf.BodyLimits.Auth), conf.Roles.Rules)
 		if err != nil {
-			log.Println(err)
+			logging.FromRequest(r).WithError(err).Warn("OAuth login failed")
 		}
 	}
 }
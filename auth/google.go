@@ -18,11 +18,11 @@
 package auth
 
 import (
-	"log"
 	"net/http"
 	"time"
 
 	"github.com/coast-team/mute-auth-proxy/config"
+	"github.com/coast-team/mute-auth-proxy/logging"
 	jwt "github.com/dgrijalva/jwt-go"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -32,12 +32,12 @@ import (
 func MakeGoogleLoginHandler(conf *config.Config) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		googleOauthConfig := oauth2.Config{
-			ClientSecret: conf.OauthPrefs.GooglePrefs.ClientSecret,
+			ClientSecret: conf.OauthPrefs.GooglePrefs.ClientSecret.Value(),
 			Endpoint:     google.Endpoint,
 		}
-		err := handleProviderCallback(w, r, "google", googleOauthConfig)
+		err := handleProviderCallback(w, r, "google", googleOauthConfig, int64(conf.BodyLimits.Auth), conf.Roles.Rules)
 		if err != nil {
-			log.Println(err)
+			logging.FromRequest(r).WithError(err).Warn("OAuth login failed")
 		}
 	}
 }
@@ -0,0 +1,98 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/coast-team/mute-auth-proxy/config"
+	"github.com/coast-team/mute-auth-proxy/helper"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// githubOrgsEndpoint lists the organizations of the GitHub user, the private memberships need the read:org scope
+const githubOrgsEndpoint = "https://api.github.com/user/orgs"
+
+// SetRoles sets the roles claim of a token
+func SetRoles(claims jwt.MapClaims, roles []string) {
+	claims[helper.RolesClaim] = strings.Join(roles, " ")
+}
+
+// grantedRoles returns the base role followed by the roles of the rules matching the login,
+// one of its GitHub organizations or its Google hosted domain
+func grantedRoles(rules []config.RoleRule, base, login string, githubOrgs []string, googleDomain string) []string {
+	roles := []string{base}
+	for _, rule := range rules {
+		if helper.StringInSlice(rule.Role, roles) {
+			continue
+		}
+		if helper.StringInSlice(login, rule.Logins) || matchesAny(rule.GithubOrgs, githubOrgs) ||
+			(googleDomain != "" && matchesAny(rule.GoogleDomains, []string{googleDomain})) {
+			roles = append(roles, rule.Role)
+		}
+	}
+	return roles
+}
+
+// matchesAny returns true if one of the values is in the list, the case is ignored
+func matchesAny(list, values []string) bool {
+	for _, a := range list {
+		for _, b := range values {
+			if strings.EqualFold(a, b) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// needsGithubOrgs returns true if a rule grants a role to the members of GitHub organizations
+func needsGithubOrgs(rules []config.RoleRule) bool {
+	for _, rule := range rules {
+		if len(rule.GithubOrgs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchGithubOrgs returns the organizations of the GitHub user authenticated by the client
+func fetchGithubOrgs(client *http.Client) ([]string, error) {
+	response, err := client.Get(githubOrgsEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GitHub answered %s", response.Status)
+	}
+	var orgs []struct {
+		Login string `json:"login"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&orgs); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(orgs))
+	for i, org := range orgs {
+		names[i] = org.Login
+	}
+	return names, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/audit"
+	"github.com/spf13/cobra"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Inspect the audit log.",
+	Long:  `Inspect the hash-chained audit log of the security-relevant events (logins, token issuance, key changes and authorization denials).`,
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify the hash chain of the audit log.",
+	Long: `Verify the sequence numbers and the hash chain of the audit log.
+Exits with a non-zero status and prints the first broken entry if an entry has been modified, inserted or removed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		verifyAudit(cmd)
+		return nil
+	},
+}
+
+var auditListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Print the audit log entries.",
+	Long:  `Print the audit log entries as JSON lines, optionally filtered by login (or actor), event and time range (RFC 3339 times).`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		listAudit(cmd)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(auditCmd)
+	auditCmd.AddCommand(auditVerifyCmd)
+	auditCmd.AddCommand(auditListCmd)
+	addConfigFlags(auditVerifyCmd.Flags())
+	addConfigFlags(auditListCmd.Flags())
+	auditListCmd.Flags().String("login", "", "Only the entries about or triggered by this login")
+	auditListCmd.Flags().String("event", "", "Only the entries of this event (login, login_failed, token_issued, key_added, key_updated, key_deleted, access_denied)")
+	auditListCmd.Flags().String("since", "", "Only the entries at or after this time, e.g. 2018-03-01T00:00:00Z")
+	auditListCmd.Flags().String("until", "", "Only the entries at or before this time")
+}
+
+// openAuditFile opens the audit log file given by the configuration
+func openAuditFile(cmd *cobra.Command) *os.File {
+	conf, err := loadConfig(cmd)
+	if err != nil {
+		log.Fatalf("Couldn't load the config.\nError was: %s", err)
+	}
+	if conf.Audit.File == "" {
+		log.Fatal("The audit log is disabled (audit.file is empty)")
+	}
+	file, err := os.Open(conf.Audit.File)
+	if err != nil {
+		log.Fatalf("Couldn't open the audit log.\nError was: %s", err)
+	}
+	return file
+}
+
+func verifyAudit(cmd *cobra.Command) {
+	file := openAuditFile(cmd)
+	defer file.Close()
+	count, err := audit.Verify(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Audit log OK, %d entries verified.\n", count)
+}
+
+func listAudit(cmd *cobra.Command) {
+	var filter audit.Filter
+	var err error
+	filter.Login, _ = cmd.Flags().GetString("login")
+	filter.Event, _ = cmd.Flags().GetString("event")
+	if filter.Since, err = parseTimeFlag(cmd, "since"); err != nil {
+		log.Fatal(err)
+	}
+	if filter.Until, err = parseTimeFlag(cmd, "until"); err != nil {
+		log.Fatal(err)
+	}
+	file := openAuditFile(cmd)
+	defer file.Close()
+	enc := json.NewEncoder(os.Stdout)
+	err = audit.Read(file, filter, func(e audit.Entry) error {
+		return enc.Encode(e)
+	})
+	if err != nil {
+		log.Fatalf("Couldn't read the audit log.\nError was: %s", err)
+	}
+}
+
+// parseTimeFlag parses an RFC 3339 time flag, the zero time is returned if it is not set
+func parseTimeFlag(cmd *cobra.Command, name string) (time.Time, error) {
+	value, err := cmd.Flags().GetString(name)
+	if err != nil || value == "" {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid --%s time: %v", name, err)
+	}
+	return t, nil
+}
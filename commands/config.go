@@ -0,0 +1,107 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package commands
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/coast-team/mute-auth-proxy/audit"
+	"github.com/coast-team/mute-auth-proxy/config"
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/spf13/cobra"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration.",
+	Long:  `Inspect the configuration of the Mute Authentication Proxy.`,
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the effective configuration.",
+	Long: `Print the effective configuration and where each value comes from (default, config file, environment variable, flag or secret file).
+Secrets are never printed, only *** is shown when they are set.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		showConfig(cmd)
+		return nil
+	},
+}
+
+var configCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Validate the configuration.",
+	Long: `Validate the configuration and print all the problems found, with the path of the faulty fields.
+Exits with a non-zero status if the configuration is invalid.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		checkConfig(cmd)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configShowCmd)
+	configCmd.AddCommand(configCheckCmd)
+	addConfigFlags(configShowCmd.Flags())
+	addConfigFlags(configCheckCmd.Flags())
+}
+
+func showConfig(cmd *cobra.Command) {
+	conf, err := loadConfig(cmd)
+	if err != nil {
+		log.Fatalf("Couldn't load the config.\nError was: %s", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+	for _, entry := range conf.Entries() {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", entry.Key, entry.Value, entry.Source)
+	}
+	w.Flush()
+}
+
+func checkConfig(cmd *cobra.Command) {
+	conf, err := loadConfig(cmd)
+	if err != nil {
+		log.Fatalf("Couldn't load the config.\nError was: %s", err)
+	}
+	if err = conf.Validate(vocabulary()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("Configuration OK.")
+}
+
+// vocabulary returns the accepted values of the settings defined outside the config package
+func vocabulary() config.Vocabulary {
+	vocab := config.Vocabulary{LogLevels: logging.Levels, LogFormats: logging.Formats, Roles: helper.Roles, Events: audit.Events}
+	for version := range helper.TLSVersions {
+		vocab.TLSVersions = append(vocab.TLSVersions, version)
+	}
+	for policy := range helper.CipherPolicies {
+		vocab.CipherPolicies = append(vocab.CipherPolicies, policy)
+	}
+	sort.Strings(vocab.TLSVersions)
+	sort.Strings(vocab.CipherPolicies)
+	return vocab
+}
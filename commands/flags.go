@@ -0,0 +1,72 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package commands
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/coast-team/mute-auth-proxy/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// addConfigFlags adds the config file flag and one flag per configuration field
+func addConfigFlags(flags *pflag.FlagSet) {
+	flags.StringP("config", "c", "config.toml", fmt.Sprintf("The config file to load, it is optional unless given explicitly (env %s)", config.EnvName("config")))
+	defaults := config.Default()
+	for _, f := range config.Fields() {
+		usage := fmt.Sprintf("%s (env %s)", f.Usage, f.Env())
+		if value := f.Get(defaults); value != "" {
+			usage = fmt.Sprintf("%s (default %s)", usage, value)
+		}
+		if f.Secret {
+			usage = fmt.Sprintf("%s - prefer the environment variable, flags are visible in the process list", usage)
+		}
+		if f.Key == "keyfile" {
+			flags.StringP(f.Flag(), "k", "", usage)
+		} else {
+			flags.String(f.Flag(), "", usage)
+		}
+	}
+}
+
+// configFile returns the path of the config file to load and whether it is required to exist
+func configFile(cmd *cobra.Command) (string, bool) {
+	flags := cmd.Flags()
+	file, _ := flags.GetString("config")
+	required := flags.Changed("config")
+	if env := os.Getenv(config.EnvName("config")); env != "" && !required {
+		file = env
+		required = true
+	}
+	return file, required
+}
+
+// loadConfig loads the configuration from the defaults, the config file, the environment and the command-line flags
+func loadConfig(cmd *cobra.Command) (*config.Config, error) {
+	flags := cmd.Flags()
+	file, required := configFile(cmd)
+	overrides := make(map[string]string)
+	for _, f := range config.Fields() {
+		if flags.Changed(f.Flag()) {
+			overrides[f.Key], _ = flags.GetString(f.Flag())
+		}
+	}
+	return config.Load(file, required, overrides)
+}
@@ -0,0 +1,78 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package commands
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+
+	"github.com/BurntSushi/toml"
+	"github.com/coast-team/mute-auth-proxy/config"
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var genClientCmd = &cobra.Command{
+	Use:   "generate-client",
+	Short: "Generate the credentials of a service client.",
+	Long: `Generate a client secret for a service (the BotStorage for example) and print the config entry to add in config.toml.
+The service can then get short-lived JWTs from the /oauth/token route with the client credentials grant.
+Only the bcrypt hash of the secret is stored in the config file, the secret is printed once.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		genclient(cmd)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(genClientCmd)
+	genClientCmd.Flags().StringP("id", "i", "botlogin", "The client ID of the service (bot.storage for example)")
+	genClientCmd.Flags().StringSliceP("scopes", "s", []string{"botstorage"}, "The scopes the service is allowed to request")
+}
+
+func genclient(cmd *cobra.Command) {
+	clientID, err := cmd.Flags().GetString("id")
+	if err != nil {
+		log.Fatalf("Couldn't extract flag, error is : %s", err)
+	}
+	scopes, err := cmd.Flags().GetStringSlice("scopes")
+	if err != nil {
+		log.Fatalf("Couldn't extract flag, error is : %s", err)
+	}
+	secret := base64.RawURLEncoding.EncodeToString(helper.GenerateRandomBytes())
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatalf("Couldn't hash the client secret, error is : %s", err)
+	}
+
+	var entry = struct {
+		Oauth struct {
+			Clients []config.ServiceClient `toml:"clients"`
+		} `toml:"oauth"`
+	}{}
+	entry.Oauth.Clients = []config.ServiceClient{{ID: clientID, SecretHash: string(hash), Scopes: scopes}}
+	var buf bytes.Buffer
+	if err = toml.NewEncoder(&buf).Encode(entry); err != nil {
+		log.Fatalf("Couldn't encode the client entry, error is : %s", err)
+	}
+
+	fmt.Printf("Client ID: %s\nClient secret: %s\n\nAdd the following entry to config.toml:\n\n%s", clientID, secret, buf.String())
+}
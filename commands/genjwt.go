@@ -19,10 +19,13 @@ package commands
 
 import (
 	"log"
+	"strings"
 
+	"github.com/coast-team/mute-auth-proxy/audit"
 	"github.com/coast-team/mute-auth-proxy/auth"
-
+	"github.com/coast-team/mute-auth-proxy/config"
 	"github.com/coast-team/mute-auth-proxy/helper"
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/spf13/cobra"
 )
 
@@ -41,6 +44,8 @@ func init() {
 	RootCmd.AddCommand(genJWTCmd)
 	genJWTCmd.Flags().StringP("botlogin", "l", "botlogin", "The login of the Bot (bot.storage for example)")
 	genJWTCmd.Flags().StringP("keyfile", "k", "symmetric_key_file", "The key file (HMAC with SHA256 used for JWT signing) to load")
+	genJWTCmd.Flags().StringSlice("role", []string{helper.RoleBot}, "The roles of the token: user, admin, bot or auditor, repeat the flag to grant several")
+	genJWTCmd.Flags().String("audit-file", config.Default().Audit.File, "The audit log recording the issued token, empty to skip the audit")
 }
 
 func genjwt(cmd *cobra.Command) {
@@ -60,9 +65,34 @@ func genjwt(cmd *cobra.Command) {
 	helper.SetSecret(keyData)
 	token := helper.GenerateJWT()
 	auth.SetClaims(token, map[string]interface{}{"login": botlogin}, "bot")
+	roles, err := cmd.Flags().GetStringSlice("role")
+	if err != nil {
+		log.Fatalf("Couldn't extract flag, error is : %s", err)
+	}
+	for _, role := range roles {
+		if !helper.StringInSlice(role, helper.Roles) {
+			log.Fatalf("Unknown role %q, the roles are %s", role, strings.Join(helper.Roles, ", "))
+		}
+	}
+	auth.SetRoles(token.Claims.(jwt.MapClaims), roles)
 	tokenString, err := helper.GetSignedString(token)
 	if err != nil {
 		log.Fatalf("Couldn't sign the jwt, error is : %s", err)
 	}
+	auditFile, err := cmd.Flags().GetString("audit-file")
+	if err != nil {
+		log.Fatalf("Couldn't extract flag, error is : %s", err)
+	}
+	if auditFile != "" {
+		auditLog, err := audit.Open(auditFile)
+		if err != nil {
+			log.Fatalf("Couldn't open the audit log.\nError was: %s", err)
+		}
+		err = auditLog.Append(audit.Entry{Event: audit.EventTokenIssued, Login: botlogin, Provider: "cli", Detail: auth.TokenDetail(token.Claims.(jwt.MapClaims))})
+		auditLog.Close()
+		if err != nil {
+			log.Fatalf("Couldn't record the token in the audit log.\nError was: %s", err)
+		}
+	}
 	log.Println(tokenString)
 }
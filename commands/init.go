@@ -37,10 +37,14 @@ var initCmd = &cobra.Command{
 	Long: `Creates a file config.toml in the current working directory with the following content:
 
 port = 4000
-coniksserver_addr = "https://localhost:8400"
+coniksserver_addr = "tcp://localhost:8400"
+keyserver_path = "keyserver"
+botstorage_addr = "http://localhost:4100"
 allowed_origins = ["http://localhost:4200"]
+keyfile = "symmetric_key_file"
 
 [oauth]
+  client_token_ttl = "1h0m0s"
   [oauth.google]
     client_secret = "GOOGLE CLIENT SECRET"
   [oauth.github]
@@ -61,7 +65,16 @@ Please fill this config file with the appropriate information.
 		if written {
 			fmt.Println("Symmetric key saved.")
 		}
-		written = generateConfigFile(dir)
+		gencert, err := cmd.Flags().GetBool("gencert")
+		if err != nil {
+			log.Fatalf("Couldn't extract flag, error is : %s", err)
+		}
+		var tlsConf config.TLSConfig
+		if gencert {
+			tlsConf = generateDevCertificate(dir)
+			fmt.Println("Self-signed development certificate saved.")
+		}
+		written = generateConfigFile(dir, keyfilename, tlsConf)
 		if written {
 			fmt.Println("Please fill the generated config file.")
 		}
@@ -74,6 +87,8 @@ func init() {
 		"The path where to save the generated config file. (If the path denotes a directory then the config file path will be path/config.toml)")
 	initCmd.Flags().StringP("genkeyfile", "k", "symmetric_key_file",
 		"If this flag is specified, it will generate the symmetric key file (HMAC with SHA256 used for JWT signing) at the given location. The default location is ./symmetric_key_file")
+	initCmd.Flags().Bool("gencert", false,
+		"Generate a self-signed certificate for localhost (cert.pem and key.pem) and enable TLS in the config file. For development only.")
 }
 
 // GenSymmetricKeyFile generates a key file with 256 bits symmetric key for HMAC.
@@ -89,7 +104,25 @@ func generateSymmetricKeyFile(dir, filepath string) bool {
 	return written
 }
 
-func generateConfigFile(filepath string) bool {
+// generateDevCertificate generates a self-signed certificate for localhost and returns the TLS config using it
+func generateDevCertificate(dir string) config.TLSConfig {
+	certPEM, keyPEM, err := helper.GenerateSelfSignedCert([]string{"localhost", "127.0.0.1", "::1"})
+	if err != nil {
+		log.Fatalf("Couldn't generate the certificate.\nError was: %s", err)
+	}
+	tlsConf := config.Default().TLS
+	tlsConf.CertFile = "cert.pem"
+	tlsConf.KeyFile = "key.pem"
+	if _, err = helper.WriteFile(path.Join(dir, tlsConf.CertFile), certPEM, 0644); err != nil {
+		log.Fatalf("Couldn't write the certificate.\nError was: %s", err)
+	}
+	if _, err = helper.WriteFile(path.Join(dir, tlsConf.KeyFile), keyPEM, 0600); err != nil {
+		log.Fatalf("Couldn't write the certificate key.\nError was: %s", err)
+	}
+	return tlsConf
+}
+
+func generateConfigFile(filepath, keyfilename string, tlsConf config.TLSConfig) bool {
 	fileinfo, err := os.Stat(filepath)
 	if err != nil && !os.IsNotExist(err) {
 		log.Fatalf("Couldn't get the file description of %s.\nError was: %s", filepath, err)
@@ -97,20 +130,13 @@ func generateConfigFile(filepath string) bool {
 	if !os.IsNotExist(err) && fileinfo.Mode().IsDir() {
 		filepath = path.Join(filepath, "config.toml")
 	}
-	var conf = config.Config{
-		Port:             4000,
-		ConiksServerAddr: "http://localhost:8400",
-		BotStorageAddr:   "http://localhost:4000",
-		AllowedOrigins:   []string{"http://localhost:4200"},
-		OauthPrefs: config.OauthConfig{
-			GooglePrefs: config.ProviderPrefs{
-				ClientSecret: "GOOGLE CLIENT SECRET",
-			},
-			GithubPrefs: config.ProviderPrefs{
-				ClientSecret: "GITHUB CLIENT SECRET",
-			},
-		},
+	var conf = config.Default()
+	conf.KeyFile = keyfilename
+	if tlsConf.Enabled() {
+		conf.TLS = tlsConf
 	}
+	conf.OauthPrefs.GooglePrefs.ClientSecret = "GOOGLE CLIENT SECRET"
+	conf.OauthPrefs.GithubPrefs.ClientSecret = "GITHUB CLIENT SECRET"
 
 	var confBuf bytes.Buffer
 	enc := toml.NewEncoder(&confBuf)
@@ -0,0 +1,142 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package commands
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/api"
+	"github.com/coast-team/mute-auth-proxy/config"
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/coast-team/mute-auth-proxy/ratelimit"
+	"github.com/dgraph-io/badger"
+	"github.com/spf13/cobra"
+)
+
+// configPollInterval is the interval between two checks of the config file modification time
+const configPollInterval = 5 * time.Second
+
+// restartFields are the config fields whose change is only taken into account after a restart
+var restartFields = []string{"port", "keyserver_path", "keyfile", "key",
+	"server.read_timeout", "server.write_timeout", "server.idle_timeout", "server.shutdown_timeout",
+	"tls.cert_file", "tls.key_file", "tls.min_version", "tls.cipher_policy", "tls.client_ca_file",
+	"metrics.addr", "admin.addr", "admin.client_ca_file", "audit.file", "public_key.purge_interval", "public_key.archive_expired_keys",
+	"public_key.change_retention", "webhooks.subscriptions", "webhooks.timeout", "webhooks.max_attempts",
+	"webhooks.initial_backoff", "webhooks.max_backoff"}
+
+// reloader serves the requests with the current handler and rebuilds it when the configuration is reloaded.
+// The in-flight requests keep being served by the handler (and the config) they started with.
+type reloader struct {
+	cmd     *cobra.Command
+	db      *badger.DB
+	limits  ratelimit.Store // kept across the reloads, so that a reload doesn't reset the rate limits
+	handler atomic.Value    // http.Handler
+
+	mu      sync.Mutex // guards conf, proxy and modTime
+	conf    *config.Config
+	proxy   *api.BotStorageReverseProxy
+	modTime time.Time
+}
+
+func newReloader(cmd *cobra.Command, conf *config.Config, db *badger.DB) *reloader {
+	rl := &reloader{cmd: cmd, db: db, limits: ratelimit.NewMemoryStore(), conf: conf, proxy: api.New("/botstorage", conf.BotStorageAddr)}
+	rl.modTime = rl.configModTime()
+	rl.handler.Store(newHandler(conf, db, rl.proxy, rl.limits))
+	return rl
+}
+
+// Close releases the connection pools of the current handler
+func (rl *reloader) Close() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.proxy.Close()
+}
+
+func (rl *reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rl.handler.Load().(http.Handler).ServeHTTP(w, r)
+}
+
+// watch reloads the configuration on SIGHUP or when the config file is modified
+func (rl *reloader) watch() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sighup:
+			rl.reload("SIGHUP received")
+		case <-ticker.C:
+			modTime := rl.configModTime()
+			rl.mu.Lock()
+			changed := !modTime.Equal(rl.modTime)
+			rl.mu.Unlock()
+			if changed {
+				rl.reload("config file changed")
+			}
+		}
+	}
+}
+
+// reload loads and validates the configuration, then swaps the handler.
+// The current configuration is kept if the new one is invalid.
+func (rl *reloader) reload(reason string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.modTime = rl.configModTime()
+	conf, err := loadConfig(rl.cmd)
+	if err != nil {
+		logging.Log.WithError(err).WithField("reason", reason).Error("Config reload failed, keeping the current config")
+		return
+	}
+	if err = conf.Validate(vocabulary()); err != nil {
+		logging.Log.WithError(err).WithField("reason", reason).Error("Config reload failed, keeping the current config")
+		return
+	}
+	for _, f := range config.Fields() {
+		if f.Get(conf) != f.Get(rl.conf) && helper.StringInSlice(f.Key, restartFields) {
+			logging.Log.WithField("field", f.Key).Warn("Config reload: the change will only be applied after a restart")
+		}
+	}
+	if err = logging.Setup(conf.Log.Level, conf.Log.Format, conf.Log.Redact); err != nil {
+		logging.Log.WithError(err).Error("Config reload: couldn't apply the log settings")
+	}
+	proxy := api.New("/botstorage", conf.BotStorageAddr)
+	rl.handler.Store(newHandler(conf, rl.db, proxy, rl.limits))
+	rl.proxy.Close()
+	rl.conf = conf
+	rl.proxy = proxy
+	logging.Log.WithField("reason", reason).Info("Config reloaded")
+}
+
+// configModTime returns the modification time of the config file, or the zero time if there is none
+func (rl *reloader) configModTime() time.Time {
+	file, _ := configFile(rl.cmd)
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
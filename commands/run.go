@@ -18,17 +18,29 @@
 package commands
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/coast-team/mute-auth-proxy/api"
+	"github.com/coast-team/mute-auth-proxy/audit"
 	"github.com/coast-team/mute-auth-proxy/auth"
 	"github.com/coast-team/mute-auth-proxy/config"
 	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/coast-team/mute-auth-proxy/metrics"
+	"github.com/coast-team/mute-auth-proxy/ratelimit"
+	"github.com/coast-team/mute-auth-proxy/webhook"
 	"github.com/dgraph-io/badger"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
@@ -45,51 +57,254 @@ var runCmd = &cobra.Command{
 
 func init() {
 	RootCmd.AddCommand(runCmd)
-	runCmd.Flags().StringP("config", "c", "config.toml", "The config file to load")
-	runCmd.Flags().StringP("keyfile", "k", "symmetric_key_file", "The key file (HMAC with SHA256 used for JWT signing) to load")
+	addConfigFlags(runCmd.Flags())
 }
 
 func run(cmd *cobra.Command) {
-	var err error
-	confFilename, err := cmd.Flags().GetString("config")
+	conf, err := loadConfig(cmd)
 	if err != nil {
-		log.Fatalf("Couldn't extract flag, error is : %s", err)
+		log.Fatalf("Couldn't load the config.\nError was: %s", err)
 	}
-	keyfilepath, err := cmd.Flags().GetString("keyfile")
-	if err != nil {
-		log.Fatalf("Couldn't extract flag, error is : %s", err)
+	if err = logging.Setup(conf.Log.Level, conf.Log.Format, conf.Log.Redact); err != nil {
+		log.Fatalf("Couldn't set up the logger.\nError was: %s", err)
 	}
-	keyData, err := helper.ReadFile(keyfilepath)
-	if err != nil {
-		log.Fatalf("Couldn't load the keyfile.\nError was: %s", err)
+	logging.Log.Info(conf)
+	if err = conf.Validate(vocabulary()); err != nil {
+		logging.Log.Fatal(err)
 	}
-	helper.SetSecret(keyData)
-	conf, err := config.LoadConfig(confFilename)
+	keyData, err := conf.SigningKey()
 	if err != nil {
-		log.Fatalf("Couldn't load the config.\nError was: %s", err)
+		logging.Log.WithError(err).Fatal("Couldn't load the signing key")
 	}
-	log.Println(conf)
-	proxy := api.New("/botstorage", conf.BotStorageAddr)
-	router := mux.NewRouter()
-	router.HandleFunc("/auth/google", auth.MakeGoogleLoginHandler(conf))
-	router.HandleFunc("/auth/github", auth.MakeGithubLoginHandler(conf))
-	router.HandleFunc("/coniks", api.MakeConiksProxyHandler(conf))
-	router.PathPrefix("/botstorage").HandlerFunc(api.MakeBotStorageProxyHandler(proxy))
+	helper.SetSecret(keyData)
 	opts := badger.DefaultOptions
 	opts.Dir = conf.KeyServerPath
 	opts.ValueDir = conf.KeyServerPath
 	db, err := badger.Open(opts)
 	if err != nil {
-		log.Fatalf("Open Badger DB: %s", err)
-	}
-	defer db.Close()
-	router.HandleFunc("/public-key/{login}", api.MakePublicKeyGETAllHandler(db)).Methods("GET")
-	router.HandleFunc("/public-key/{login}/{device}", api.MakePublicKeyGETHandler(db)).Methods("GET")
-	router.HandleFunc("/public-key", api.MakePublicKeyPOSTHandler(db)).Methods("POST")
-	router.HandleFunc("/public-key/{login}/{device}", api.MakePublicKeyPUTHandler(db)).Methods("PUT")
-	handlerFunc := handlers.CORS(handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}), handlers.AllowedMethods([]string{"GET", "POST", "OPTIONS", "PUT", "DELETE"}), handlers.AllowedOrigins(conf.AllowedOrigins))(router)
-	err = http.ListenAndServe(fmt.Sprintf(":%d", conf.Port), handlerFunc)
+		logging.Log.WithError(err).Fatal("Couldn't open the key server database")
+	}
+	var auditLog *audit.Log
+	if conf.Audit.File != "" {
+		auditLog, err = audit.Open(conf.Audit.File)
+		if err != nil {
+			db.Close()
+			logging.Log.WithError(err).Fatal("Couldn't open the audit log")
+		}
+		audit.SetLog(auditLog)
+	}
+	helper.SetTokenCheck(api.MakeTokenCheck(db))
+	rl := newReloader(cmd, conf, db)
+	go rl.watch()
+	purger := api.NewKeyPurger(db, conf.PublicKey)
+	go purger.Run()
+	dispatcher := webhook.NewDispatcher(db, conf.Webhooks)
+	audit.SetObserver(dispatcher.Enqueue)
+	go dispatcher.Run()
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", conf.Port),
+		Handler:      rl,
+		ReadTimeout:  conf.Server.ReadTimeout.Duration,
+		WriteTimeout: conf.Server.WriteTimeout.Duration,
+		IdleTimeout:  conf.Server.IdleTimeout.Duration,
+	}
+	if conf.TLS.Enabled() {
+		srv.TLSConfig, err = newTLSConfig(conf.TLS)
+		if err != nil {
+			db.Close()
+			logging.Log.WithError(err).Fatal("Couldn't set up TLS")
+		}
+	}
+	srv.RegisterOnShutdown(api.CloseKeyEventStreams)
+	servers := []*http.Server{srv}
+	if conf.Metrics.Addr != "" && conf.Metrics.Path != "" {
+		adminSrv := newAdminServer(conf)
+		servers = append(servers, adminSrv)
+		go func() {
+			if err := adminSrv.ListenAndServe(); err != http.ErrServerClosed {
+				logging.Log.WithError(err).Error("Admin listener stopped")
+			}
+		}()
+	}
+	if conf.Admin.Addr != "" {
+		adminAPISrv, err := newAdminAPIServer(conf, db)
+		if err != nil {
+			db.Close()
+			logging.Log.WithError(err).Fatal("Couldn't set up the admin API listener")
+		}
+		servers = append(servers, adminAPISrv)
+		go func() {
+			var err error
+			if adminAPISrv.TLSConfig != nil {
+				err = adminAPISrv.ListenAndServeTLS("", "")
+			} else {
+				err = adminAPISrv.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				logging.Log.WithError(err).Error("Admin API listener stopped")
+			}
+		}()
+	}
+	drained := make(chan struct{})
+	go shutdownOnSignal(servers, conf.Server.ShutdownTimeout.Duration, drained)
+	if srv.TLSConfig != nil {
+		// The certificate is given by TLSConfig.GetCertificate
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		db.Close()
+		logging.Log.WithError(err).Fatal("Couldn't listen")
+	}
+	<-drained
+	purger.Stop()
+	audit.SetObserver(nil)
+	dispatcher.Stop()
+	rl.Close()
+	helper.SetTokenCheck(nil)
+	if auditLog != nil {
+		audit.SetLog(nil)
+		auditLog.Close()
+	}
+	if err = db.Close(); err != nil {
+		logging.Log.WithError(err).Fatal("Couldn't close the key server database")
+	}
+	logging.Log.Info("Shutdown complete")
+}
+
+// newTLSConfig creates the server TLS config, the certificate is reloaded when its files change
+func newTLSConfig(conf config.TLSConfig) (*tls.Config, error) {
+	cr, err := helper.NewCertReloader(conf.CertFile, conf.KeyFile)
 	if err != nil {
-		log.Fatalf("ListenAndServe: %s", err)
+		return nil, err
+	}
+	return helper.NewTLSConfig(cr, conf.MinVersion, conf.CipherPolicy, conf.ClientCAFile)
+}
+
+// newAdminServer creates the admin listener serving the metrics
+func newAdminServer(conf *config.Config) *http.Server {
+	adminMux := http.NewServeMux()
+	adminMux.Handle(conf.Metrics.Path, metrics.Handler())
+	logging.Log.WithFields(logrus.Fields{"addr": conf.Metrics.Addr, "path": conf.Metrics.Path}).Info("Serving the metrics on the admin listener")
+	return &http.Server{
+		Addr:         conf.Metrics.Addr,
+		Handler:      adminMux,
+		ReadTimeout:  conf.Server.ReadTimeout.Duration,
+		WriteTimeout: conf.Server.WriteTimeout.Duration,
+		IdleTimeout:  conf.Server.IdleTimeout.Duration,
+	}
+}
+
+// newAdminAPIServer creates the admin API listener. With TLS, it serves the proxy certificate and verifies the
+// client certificates with the admin CA.
+func newAdminAPIServer(conf *config.Config, db *badger.DB) (*http.Server, error) {
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(helper.NotFoundHandler)
+	router.MethodNotAllowedHandler = http.HandlerFunc(helper.MethodNotAllowedHandler)
+	router.Use(logging.Middleware, metrics.Middleware)
+	// the certificates verified by the admin CA are the admins'
+	authz := api.NewAuthorizer(helper.RoleAdmin)
+	reader := authz.Require(helper.RoleAdmin, helper.RoleAuditor)
+	admin := authz.Require(helper.RoleAdmin)
+	router.HandleFunc("/admin/logins", reader(api.MakeAdminLoginsHandler(db))).Methods("GET")
+	router.HandleFunc("/admin/logins/{login}", reader(api.MakeAdminLoginHandler(db))).Methods("GET")
+	router.HandleFunc("/admin/logins/{login}/history", reader(api.MakeAdminKeyHistoryHandler(db))).Methods("GET")
+	router.HandleFunc("/admin/logins/{login}/devices/{device}", admin(api.MakeAdminDeviceDELETEHandler(db))).Methods("DELETE")
+	router.HandleFunc("/admin/logins/{login}/block", admin(api.MakeAdminBlockPUTHandler(db))).Methods("PUT")
+	router.HandleFunc("/admin/logins/{login}/block", admin(api.MakeAdminBlockDELETEHandler(db))).Methods("DELETE")
+	router.HandleFunc("/admin/tokens/revoke", admin(api.MakeAdminRevokeHandler(db))).Methods("POST")
+	router.HandleFunc("/admin/webhooks/dead-letters", reader(webhook.MakeDeadLettersHandler(db))).Methods("GET")
+	srv := &http.Server{
+		Addr:         conf.Admin.Addr,
+		Handler:      router,
+		ReadTimeout:  conf.Server.ReadTimeout.Duration,
+		WriteTimeout: conf.Server.WriteTimeout.Duration,
+		IdleTimeout:  conf.Server.IdleTimeout.Duration,
+	}
+	if conf.TLS.Enabled() {
+		tlsConf := conf.TLS
+		tlsConf.ClientCAFile = conf.Admin.ClientCAFile
+		var err error
+		if srv.TLSConfig, err = newTLSConfig(tlsConf); err != nil {
+			return nil, err
+		}
+	}
+	logging.Log.WithFields(logrus.Fields{"addr": conf.Admin.Addr, "mtls": conf.Admin.ClientCAFile != ""}).Info("Serving the admin API")
+	return srv, nil
+}
+
+// shutdownOnSignal waits for SIGINT or SIGTERM, then stops accepting connections and waits for the in-flight requests
+// until the timeout expires. drained is closed once done.
+func shutdownOnSignal(servers []*http.Server, timeout time.Duration, drained chan<- struct{}) {
+	defer close(drained)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	sig := <-stop
+	logging.Log.WithFields(logrus.Fields{"signal": sig.String(), "timeout": timeout.String()}).Info("Shutting down, waiting for the in-flight requests")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			logging.Log.WithError(err).Warn("Graceful shutdown failed, remaining connections are closed")
+			srv.Close()
+		}
+	}
+}
+
+// rateLimit returns the function wrapping the handlers of a route group with its rate limiting policy
+func rateLimit(conf *config.Config, limits ratelimit.Store, group string, policy config.RateLimitPolicy) func(http.HandlerFunc) http.Handler {
+	if !conf.RateLimit.Enabled {
+		return func(h http.HandlerFunc) http.Handler { return h }
+	}
+	hops := 0
+	if conf.RateLimit.TrustProxyHeaders {
+		hops = conf.RateLimit.TrustedProxyHops
+	}
+	limiter := ratelimit.New(limits, hops)
+	middleware := limiter.Middleware(group, ratelimit.Policy{
+		Limit: ratelimit.Limit{Rate: policy.Rate(), Burst: policy.Burst},
+		Key:   policy.Key,
+	})
+	return func(h http.HandlerFunc) http.Handler { return middleware(h) }
+}
+
+// newHandler builds the router of the proxy and wraps it with the CORS handler.
+// limits keeps the state of the rate limiters.
+func newHandler(conf *config.Config, db *badger.DB, proxy *api.BotStorageReverseProxy, limits ratelimit.Store) http.Handler {
+	authLimit := rateLimit(conf, limits, "auth", conf.RateLimit.Auth)
+	publicKeyLimit := rateLimit(conf, limits, "public_key", conf.RateLimit.PublicKey)
+	coniksLimit := rateLimit(conf, limits, "coniks", conf.RateLimit.Coniks)
+	// the keys and the bot storage are written by the users and the bots, the certificates are the bots'
+	owner := api.NewAuthorizer(helper.RoleBot).Require(helper.RoleUser, helper.RoleBot)
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(helper.NotFoundHandler)
+	router.MethodNotAllowedHandler = http.HandlerFunc(helper.MethodNotAllowedHandler)
+	router.Use(logging.Middleware, metrics.Middleware)
+	if conf.Metrics.Path != "" && conf.Metrics.Addr == "" {
+		// on the public listener, the metrics are for the admins and the auditors
+		reader := api.NewAuthorizer(helper.RoleBot).Require(helper.RoleAdmin, helper.RoleAuditor)
+		router.Handle(conf.Metrics.Path, reader(metrics.Handler().ServeHTTP)).Methods("GET")
 	}
+	router.HandleFunc("/healthz", api.MakeHealthzHandler()).Methods("GET")
+	router.HandleFunc("/readyz", api.MakeReadyzHandler(conf, db)).Methods("GET")
+	router.Handle("/auth/google", authLimit(auth.MakeGoogleLoginHandler(conf)))
+	router.Handle("/auth/github", authLimit(auth.MakeGithubLoginHandler(conf)))
+	router.Handle("/oauth/token", authLimit(auth.MakeTokenHandler(conf))).Methods("POST")
+	router.Handle("/coniks", coniksLimit(api.MakeConiksProxyHandler(conf)))
+	router.PathPrefix("/botstorage").HandlerFunc(owner(api.MakeBotStorageProxyHandler(proxy)))
+	router.Handle("/public-key/events", publicKeyLimit(api.MakeKeyEventsHandler(conf, db))).Methods("GET")
+	router.Handle("/public-key/{login}", publicKeyLimit(api.MakePublicKeyGETAllHandler(conf, db))).Methods("GET")
+	router.Handle("/public-key/{login}/{device}", publicKeyLimit(api.MakePublicKeyGETHandler(conf, db))).Methods("GET")
+	router.Handle("/master-key/{login}", publicKeyLimit(api.MakeMasterKeyGETHandler(db))).Methods("GET")
+	router.Handle("/master-key/{login}", publicKeyLimit(owner(api.MakeMasterKeyPUTHandler(conf, db)))).Methods("PUT")
+	router.Handle("/public-key/challenge", publicKeyLimit(owner(api.MakePublicKeyChallengeHandler(conf, db)))).Methods("POST")
+	router.Handle("/public-key/lookup", publicKeyLimit(api.MakePublicKeyLookupHandler(conf, db))).Methods("POST")
+	router.Handle("/public-key", publicKeyLimit(owner(api.MakePublicKeyPOSTHandler(conf, db)))).Methods("POST")
+	router.Handle("/public-key/{login}/{device}", publicKeyLimit(owner(api.MakePublicKeyPUTHandler(conf, db)))).Methods("PUT")
+	router.Handle("/public-key/{login}/{device}", publicKeyLimit(owner(api.MakePublicKeyDELETEHandler(db)))).Methods("DELETE")
+	router.Handle("/public-key/{login}/{device}/prekeys", publicKeyLimit(owner(api.MakePrekeysPOSTHandler(conf, db)))).Methods("POST")
+	router.Handle("/public-key/{login}/{device}/prekeys", publicKeyLimit(api.MakePrekeysGETHandler(conf, db))).Methods("GET")
+	router.Handle("/public-key/{login}/{device}/prekey-bundle", publicKeyLimit(api.MakePrekeyBundleHandler(conf, db))).Methods("POST")
+	return handlers.CORS(handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "If-Match", "If-None-Match", "If-Modified-Since", "Last-Event-ID"}), handlers.ExposedHeaders([]string{"ETag", "Last-Modified", "Warning"}), handlers.AllowedMethods([]string{"GET", "POST", "OPTIONS", "PUT", "DELETE"}), handlers.AllowedOrigins(conf.AllowedOrigins))(router)
 }
@@ -18,48 +18,438 @@
 package config
 
 import (
+	"encoding/base64"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
 // Config represents the structure containing the information from the config file
 type Config struct {
-	Port             int
-	ConiksServerAddr string      `toml:"coniksserver_addr"`
-	KeyServerPath    string      `toml:"keyserver_path"`
-	BotStorageAddr   string      `toml:"botstorage_addr"`
-	AllowedOrigins   []string    `toml:"allowed_origins"`
-	OauthPrefs       OauthConfig `toml:"oauth"`
+	Port             int              `toml:"port"`
+	ConiksServerAddr string           `toml:"coniksserver_addr"`
+	KeyServerPath    string           `toml:"keyserver_path"`
+	BotStorageAddr   string           `toml:"botstorage_addr"`
+	AllowedOrigins   []string         `toml:"allowed_origins"`
+	KeyFile          string           `toml:"keyfile"`
+	Key              Secret           `toml:"key,omitempty"` // base64 encoded, takes precedence over the key file
+	Server           ServerConfig     `toml:"server"`
+	TLS              TLSConfig        `toml:"tls"`
+	Metrics          MetricsConfig    `toml:"metrics"`
+	Admin            AdminConfig      `toml:"admin"`
+	Log              LogConfig        `toml:"log"`
+	Audit            AuditConfig      `toml:"audit"`
+	Health           HealthConfig     `toml:"health"`
+	RateLimit        RateLimitConfig  `toml:"ratelimit"`
+	BodyLimits       BodyLimitsConfig `toml:"body_limits"`
+	PublicKey        PublicKeyConfig  `toml:"public_key"`
+	Webhooks         WebhooksConfig   `toml:"webhooks"`
+	Roles            RolesConfig      `toml:"roles"`
+	OauthPrefs       OauthConfig      `toml:"oauth"`
+
+	sources map[string]string // where each field has been loaded from
 }
 
 func (conf Config) String() string {
-	return fmt.Sprintf("Config:\n  Port: %d\n  Coniks server addr: %s\n  KeyServer path: %s\n  BotStorage addr: %s\n  Allowed origins: %s\n  %s", conf.Port, conf.ConiksServerAddr, conf.KeyServerPath, conf.BotStorageAddr, conf.AllowedOrigins, conf.OauthPrefs)
+	return fmt.Sprintf("Config:\n  Port: %d\n  Coniks server addr: %s\n  KeyServer path: %s\n  BotStorage addr: %s\n  Allowed origins: %s\n  Key file: %s\n  Key: %s\n  %s\n  %s\n  %s\n  %s\n  %s\n  %s\n  %s\n  %s\n  %s\n  %s\n  %s\n  %s\n  %s", conf.Port, conf.ConiksServerAddr, conf.KeyServerPath, conf.BotStorageAddr, conf.AllowedOrigins, conf.KeyFile, conf.Key, conf.Server, conf.TLS, conf.Metrics, conf.Admin, conf.Log, conf.Audit, conf.Health, conf.RateLimit, conf.BodyLimits, conf.PublicKey, conf.Webhooks, conf.Roles, conf.OauthPrefs)
+}
+
+// ServerConfig contains the timeouts of the HTTP server
+type ServerConfig struct {
+	ReadTimeout     Duration `toml:"read_timeout"`
+	WriteTimeout    Duration `toml:"write_timeout"`
+	IdleTimeout     Duration `toml:"idle_timeout"`
+	ShutdownTimeout Duration `toml:"shutdown_timeout"` // how long the in-flight requests are waited for on shutdown
+}
+
+func (conf ServerConfig) String() string {
+	return fmt.Sprintf("Server Config:\n    Read timeout: %s\n    Write timeout: %s\n    Idle timeout: %s\n    Shutdown timeout: %s", conf.ReadTimeout, conf.WriteTimeout, conf.IdleTimeout, conf.ShutdownTimeout)
+}
+
+// TLSConfig contains the settings of the TLS termination, it is enabled when the certificate file is set
+type TLSConfig struct {
+	CertFile     string `toml:"cert_file"`
+	KeyFile      string `toml:"key_file"`
+	MinVersion   string `toml:"min_version"`    // 1.0, 1.1, 1.2 or 1.3
+	CipherPolicy string `toml:"cipher_policy"`  // default or modern
+	ClientCAFile string `toml:"client_ca_file"` // enables the authentication of the bots with client certificates
+}
+
+// Enabled returns true if the proxy must serve HTTPS
+func (conf TLSConfig) Enabled() bool {
+	return conf.CertFile != ""
+}
+
+func (conf TLSConfig) String() string {
+	return fmt.Sprintf("TLS Config:\n    Cert file: %s\n    Key file: %s\n    Min version: %s\n    Cipher policy: %s\n    Client CA file: %s", conf.CertFile, conf.KeyFile, conf.MinVersion, conf.CipherPolicy, conf.ClientCAFile)
+}
+
+// MetricsConfig contains the settings of the Prometheus metrics endpoint
+type MetricsConfig struct {
+	Path string `toml:"path"` // empty to disable the endpoint
+	Addr string `toml:"addr"` // separate admin listener (host:port), the main listener is used when empty
+}
+
+func (conf MetricsConfig) String() string {
+	return fmt.Sprintf("Metrics Config:\n    Path: %s\n    Admin addr: %s", conf.Path, conf.Addr)
+}
+
+// AdminConfig contains the settings of the admin API listener
+type AdminConfig struct {
+	Addr         string `toml:"addr"`           // host:port, empty to disable the admin API
+	ClientCAFile string `toml:"client_ca_file"` // enables the authentication of the admins with client certificates
+}
+
+func (conf AdminConfig) String() string {
+	return fmt.Sprintf("Admin Config:\n    Addr: %s\n    Client CA file: %s", conf.Addr, conf.ClientCAFile)
+}
+
+// LogConfig contains the settings of the logger
+type LogConfig struct {
+	Level  string `toml:"level"`  // debug, info, warn or error
+	Format string `toml:"format"` // logfmt or json
+	Redact bool   `toml:"redact"` // redact the tokens, secrets and key material
+}
+
+func (conf LogConfig) String() string {
+	return fmt.Sprintf("Log Config:\n    Level: %s\n    Format: %s\n    Redact: %t", conf.Level, conf.Format, conf.Redact)
+}
+
+// AuditConfig contains the settings of the audit log
+type AuditConfig struct {
+	File string `toml:"file"` // empty to disable the audit log
+}
+
+func (conf AuditConfig) String() string {
+	return fmt.Sprintf("Audit Config:\n    File: %s", conf.File)
+}
+
+// HealthConfig contains the settings of the readiness checks
+type HealthConfig struct {
+	CheckTimeout Duration `toml:"check_timeout"` // timeout of each dependency check
+}
+
+func (conf HealthConfig) String() string {
+	return fmt.Sprintf("Health Config:\n    Check timeout: %s", conf.CheckTimeout)
+}
+
+// RateLimitConfig contains the rate limiting policies of the route groups
+type RateLimitConfig struct {
+	Enabled           bool            `toml:"enabled"`
+	TrustProxyHeaders bool            `toml:"trust_proxy_headers"` // take the client IP from X-Forwarded-For
+	TrustedProxyHops  int             `toml:"trusted_proxy_hops"`  // number of trusted proxies in front of the proxy
+	Auth              RateLimitPolicy `toml:"auth"`                // /auth/* and /oauth/token
+	PublicKey         RateLimitPolicy `toml:"public_key"`          // /public-key/*
+	Coniks            RateLimitPolicy `toml:"coniks"`              // /coniks
+}
+
+func (conf RateLimitConfig) String() string {
+	return fmt.Sprintf("Rate Limit Config:\n    Enabled: %t\n    Trust proxy headers: %t\n    Trusted proxy hops: %d\n    Auth: %s\n    Public key: %s\n    Coniks: %s", conf.Enabled, conf.TrustProxyHeaders, conf.TrustedProxyHops, conf.Auth, conf.PublicKey, conf.Coniks)
+}
+
+// RateLimitPolicy is a token bucket refilled with Requests tokens every Period, holding at most Burst tokens.
+// Key is ip, login or both.
+type RateLimitPolicy struct {
+	Requests int      `toml:"requests"`
+	Period   Duration `toml:"period"`
+	Burst    int      `toml:"burst"`
+	Key      string   `toml:"key"`
+}
+
+func (p RateLimitPolicy) String() string {
+	return fmt.Sprintf("%d per %s, burst %d, by %s", p.Requests, p.Period, p.Burst, p.Key)
+}
+
+// Rate returns the number of requests allowed per second
+func (p RateLimitPolicy) Rate() float64 {
+	return float64(p.Requests) / p.Period.Seconds()
+}
+
+// BodyLimitsConfig contains the maximum request body sizes, in bytes, per route group
+type BodyLimitsConfig struct {
+	Auth      int `toml:"auth"`       // /auth/* and /oauth/token
+	PublicKey int `toml:"public_key"` // /public-key/*
+	Coniks    int `toml:"coniks"`     // /coniks
+}
+
+func (conf BodyLimitsConfig) String() string {
+	return fmt.Sprintf("Body Limits Config:\n    Auth: %d\n    Public key: %d\n    Coniks: %d", conf.Auth, conf.PublicKey, conf.Coniks)
+}
+
+// PublicKeyConfig contains the settings of the key server
+type PublicKeyConfig struct {
+	ChallengeTTL       Duration `toml:"challenge_ttl"`        // how long a proof-of-possession challenge can be answered
+	MaxOneTimePrekeys  int      `toml:"max_one_time_prekeys"` // per device
+	PrekeyLowWatermark int      `toml:"prekey_low_watermark"` // the owner is warned to replenish below it
+	MaxKeyLifetime     Duration `toml:"max_key_lifetime"`     // 0 for no limit
+	ExpiryWarning      Duration `toml:"expiry_warning"`       // the owner is warned to rotate a key this long before it expires
+	ExpiredKeys        string   `toml:"expired_keys"`         // hide or flag
+	PurgeInterval      Duration `toml:"purge_interval"`       // 0 disables the purge of the expired keys
+	ArchiveExpiredKeys bool     `toml:"archive_expired_keys"` // archive the purged keys instead of deleting them
+	MaxLookupBatch     int      `toml:"max_lookup_batch"`     // the number of logins and devices a batch lookup can ask for
+	EventsHeartbeat    Duration `toml:"events_heartbeat"`     // the interval of the comments keeping the event streams open
+	ChangeRetention    Duration `toml:"change_retention"`     // how long the key changes can be replayed, 0 to keep them all
+}
+
+func (conf PublicKeyConfig) String() string {
+	return fmt.Sprintf("Public Key Config:\n    Challenge TTL: %s\n    Max one-time prekeys: %d\n    Prekey low watermark: %d\n    Max key lifetime: %s\n    Expiry warning: %s\n    Expired keys: %s\n    Purge interval: %s\n    Archive expired keys: %t\n    Max lookup batch: %d\n    Events heartbeat: %s\n    Change retention: %s",
+		conf.ChallengeTTL, conf.MaxOneTimePrekeys, conf.PrekeyLowWatermark, conf.MaxKeyLifetime, conf.ExpiryWarning, conf.ExpiredKeys, conf.PurgeInterval, conf.ArchiveExpiredKeys, conf.MaxLookupBatch, conf.EventsHeartbeat, conf.ChangeRetention)
+}
+
+// WebhooksConfig contains the webhook subscriptions and the settings of their deliveries
+type WebhooksConfig struct {
+	Subscriptions  []WebhookSubscription `toml:"subscriptions"`
+	Timeout        Duration              `toml:"timeout"`         // of a delivery request
+	MaxAttempts    int                   `toml:"max_attempts"`    // a delivery is dead-lettered after them
+	InitialBackoff Duration              `toml:"initial_backoff"` // doubled after each failed attempt
+	MaxBackoff     Duration              `toml:"max_backoff"`
+}
+
+func (conf WebhooksConfig) String() string {
+	return fmt.Sprintf("Webhooks Config:\n    Subscriptions: %s\n    Timeout: %s\n    Max attempts: %d\n    Backoff: %s to %s",
+		conf.Subscriptions, conf.Timeout, conf.MaxAttempts, conf.InitialBackoff, conf.MaxBackoff)
+}
+
+// WebhookSubscription is an URL the audited events are POSTed to, signed with the secret
+type WebhookSubscription struct {
+	URL    string   `toml:"url" json:"url"`
+	Secret Secret   `toml:"secret" json:"secret"`
+	Events []string `toml:"events" json:"events"`
+}
+
+func (s WebhookSubscription) String() string {
+	return fmt.Sprintf("%s %v", s.URL, s.Events)
+}
+
+// RolesConfig contains the rules granting roles, on top of user for the logins and bot for the bots and service clients
+type RolesConfig struct {
+	Rules []RoleRule `toml:"rules"`
+}
+
+func (conf RolesConfig) String() string {
+	return fmt.Sprintf("Roles Config:\n    Rules: %v", conf.Rules)
+}
+
+// RoleRule grants a role to the logins it matches: listed logins, members of GitHub organizations
+// or Google accounts of hosted domains
+type RoleRule struct {
+	Role          string   `toml:"role" json:"role"`
+	Logins        []string `toml:"logins" json:"logins,omitempty"`
+	GithubOrgs    []string `toml:"github_orgs" json:"github_orgs,omitempty"`
+	GoogleDomains []string `toml:"google_domains" json:"google_domains,omitempty"`
+}
+
+func (r RoleRule) String() string {
+	return fmt.Sprintf("%s: logins %v, github orgs %v, google domains %v", r.Role, r.Logins, r.GithubOrgs, r.GoogleDomains)
 }
 
 type OauthConfig struct {
-	GooglePrefs ProviderPrefs `toml:"google"`
-	GithubPrefs ProviderPrefs `toml:"github"`
+	GooglePrefs    ProviderPrefs   `toml:"google"`
+	GithubPrefs    ProviderPrefs   `toml:"github"`
+	ClientTokenTTL Duration        `toml:"client_token_ttl"`
+	Clients        []ServiceClient `toml:"clients"`
 }
 
 func (conf OauthConfig) String() string {
-	return fmt.Sprintf("Oauth Config:\n    Google Preferences:\n      %s\n    Github Preferences:\n      %s", conf.GooglePrefs, conf.GithubPrefs)
+	return fmt.Sprintf("Oauth Config:\n    Google Preferences:\n      %s\n    Github Preferences:\n      %s\n    Client token TTL: %s\n    Service clients: %s", conf.GooglePrefs, conf.GithubPrefs, conf.ClientTokenTTL, conf.Clients)
 }
 
 type ProviderPrefs struct {
-	ClientSecret string `toml:"client_secret"`
+	ClientSecret     Secret `toml:"client_secret"`
+	ClientSecretFile string `toml:"client_secret_file,omitempty"`
 }
 
 func (conf ProviderPrefs) String() string {
 	return fmt.Sprintf("Client Secret: %s", conf.ClientSecret)
 }
 
-// LoadConfig loads and parses the information from the config file and fill the Config struct
-func LoadConfig(file string) (*Config, error) {
-	var conf Config
-	if _, err := toml.DecodeFile(file, &conf); err != nil {
-		return nil, fmt.Errorf("Failed to load config: %v", err)
+// ServiceClient represents a service (a bot for example) allowed to get a JWT through the client credentials grant
+type ServiceClient struct {
+	ID         string   `toml:"client_id" json:"client_id"`
+	SecretHash string   `toml:"client_secret_hash" json:"client_secret_hash"` // bcrypt hash of the client secret
+	Scopes     []string `toml:"scopes" json:"scopes"`
+}
+
+func (c ServiceClient) String() string {
+	return fmt.Sprintf("%s %v", c.ID, c.Scopes)
+}
+
+// Duration is a time.Duration that can be decoded from a TOML string such as "1h30m"
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText parses the duration from its string representation
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// MarshalText returns the string representation of the duration
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// SigningKey returns the key used to sign the JWTs (HMAC with SHA256).
+// The base64 encoded key takes precedence over the key file.
+func (conf *Config) SigningKey() ([]byte, error) {
+	if conf.Key.IsSet() {
+		key, err := base64.StdEncoding.DecodeString(conf.Key.Value())
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode the signing key, it must be base64 encoded: %v", err)
+		}
+		return key, nil
+	}
+	if _, err := os.Stat(conf.KeyFile); os.IsNotExist(err) {
+		return nil, fmt.Errorf("Failed to load keyfile: %v", err)
+	}
+	return ioutil.ReadFile(conf.KeyFile)
+}
+
+// loadSecretFile replaces the client secret with the content of the client secret file
+func (prefs *ProviderPrefs) loadSecretFile(key string, sources map[string]string) error {
+	if prefs.ClientSecretFile == "" {
+		return nil
+	}
+	secret, err := readSecretFile(prefs.ClientSecretFile)
+	if err != nil {
+		return err
+	}
+	prefs.ClientSecret = secret
+	sources[key] = fmt.Sprintf("secret file %s", prefs.ClientSecretFile)
+	return nil
+}
+
+// Default returns the configuration used when nothing else is specified
+func Default() *Config {
+	return &Config{
+		Port:             4000,
+		ConiksServerAddr: "tcp://localhost:8400",
+		KeyServerPath:    "keyserver",
+		BotStorageAddr:   "http://localhost:4100",
+		AllowedOrigins:   []string{"http://localhost:4200"},
+		KeyFile:          "symmetric_key_file",
+		Server: ServerConfig{
+			ReadTimeout:     Duration{15 * time.Second},
+			WriteTimeout:    Duration{30 * time.Second},
+			IdleTimeout:     Duration{2 * time.Minute},
+			ShutdownTimeout: Duration{30 * time.Second},
+		},
+		TLS: TLSConfig{
+			MinVersion:   "1.2",
+			CipherPolicy: "modern",
+		},
+		Metrics: MetricsConfig{
+			Path: "/metrics",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "logfmt",
+			Redact: true,
+		},
+		Audit: AuditConfig{
+			File: "audit.log",
+		},
+		Health: HealthConfig{
+			CheckTimeout: Duration{2 * time.Second},
+		},
+		BodyLimits: BodyLimitsConfig{
+			Auth:      8 << 10,
+			PublicKey: 64 << 10,
+			Coniks:    1 << 20,
+		},
+		PublicKey: PublicKeyConfig{
+			ChallengeTTL:       Duration{5 * time.Minute},
+			MaxOneTimePrekeys:  100,
+			PrekeyLowWatermark: 10,
+			ExpiryWarning:      Duration{7 * 24 * time.Hour},
+			ExpiredKeys:        "hide",
+			PurgeInterval:      Duration{time.Hour},
+			ArchiveExpiredKeys: true,
+			MaxLookupBatch:     50,
+			EventsHeartbeat:    Duration{15 * time.Second},
+			ChangeRetention:    Duration{7 * 24 * time.Hour},
+		},
+		Webhooks: WebhooksConfig{
+			Timeout:        Duration{10 * time.Second},
+			MaxAttempts:    8,
+			InitialBackoff: Duration{30 * time.Second},
+			MaxBackoff:     Duration{time.Hour},
+		},
+		RateLimit: RateLimitConfig{
+			Enabled:          true,
+			TrustedProxyHops: 1,
+			Auth:             RateLimitPolicy{Requests: 10, Period: Duration{time.Minute}, Burst: 5, Key: "ip"},
+			PublicKey:        RateLimitPolicy{Requests: 120, Period: Duration{time.Minute}, Burst: 30, Key: "both"},
+			Coniks:           RateLimitPolicy{Requests: 60, Period: Duration{time.Minute}, Burst: 20, Key: "login"},
+		},
+		OauthPrefs: OauthConfig{
+			ClientTokenTTL: Duration{time.Hour},
+		},
+	}
+}
+
+// Load builds the configuration. By increasing order of precedence, the values are taken from
+// the defaults, the config file, the MUTE_AUTH_PROXY_* environment variables and the overrides
+// (the command-line flags, indexed by TOML key).
+// A missing config file is ignored unless required is true.
+func Load(file string, required bool, overrides map[string]string) (*Config, error) {
+	conf := Default()
+	conf.sources = make(map[string]string)
+	if _, err := os.Stat(file); err == nil || required {
+		meta, err := toml.DecodeFile(file, conf)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load config: %v", err)
+		}
+		for _, key := range meta.Keys() {
+			conf.sources[strings.ToLower(key.String())] = fmt.Sprintf("file %s", file)
+		}
+	}
+
+	// The secret files are not read if the secret itself is given by the environment or a flag
+	overridden := make(map[string]bool)
+	for _, f := range fields {
+		env := f.Env()
+		if value := os.Getenv(env); value != "" {
+			if err := f.set(conf, value); err != nil {
+				return nil, fmt.Errorf("Failed to load config from %s: %v", env, err)
+			}
+			conf.sources[f.Key] = fmt.Sprintf("env %s", env)
+			overridden[f.Key] = true
+		}
+	}
+	for key, value := range overrides {
+		f, ok := lookupField(key)
+		if !ok {
+			return nil, fmt.Errorf("Failed to load config: unknown key %s", key)
+		}
+		if err := f.set(conf, value); err != nil {
+			return nil, fmt.Errorf("Failed to load config from --%s: %v", f.Flag(), err)
+		}
+		conf.sources[f.Key] = fmt.Sprintf("flag --%s", f.Flag())
+		overridden[f.Key] = true
+	}
+
+	if !overridden["oauth.google.client_secret"] {
+		if err := conf.OauthPrefs.GooglePrefs.loadSecretFile("oauth.google.client_secret", conf.sources); err != nil {
+			return nil, fmt.Errorf("Failed to load config: %v", err)
+		}
+	}
+	if !overridden["oauth.github.client_secret"] {
+		if err := conf.OauthPrefs.GithubPrefs.loadSecretFile("oauth.github.client_secret", conf.sources); err != nil {
+			return nil, fmt.Errorf("Failed to load config: %v", err)
+		}
 	}
 
-	return &conf, nil
+	return conf, nil
+}
+
+// LoadConfig loads and parses the information from the config file and fill the Config struct
+func LoadConfig(file string) (*Config, error) {
+	return Load(file, true, nil)
 }
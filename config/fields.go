@@ -0,0 +1,319 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of the environment variables read by the config package
+const EnvPrefix = "MUTE_AUTH_PROXY_"
+
+// Entry is a configuration field with its effective value and where it comes from
+type Entry struct {
+	Key    string
+	Value  string
+	Source string
+}
+
+// Field describes a configuration field that can be set from the config file (by its TOML key),
+// from an environment variable or from a command-line flag
+type Field struct {
+	Key    string
+	Usage  string
+	Secret bool // secrets should not be given as command-line flags since they are visible in the process list
+	get    func(conf *Config) string
+	set    func(conf *Config, value string) error
+}
+
+// Env returns the name of the environment variable that overrides the field
+func (f Field) Env() string {
+	return EnvName(f.Key)
+}
+
+// Flag returns the name of the command-line flag that overrides the field
+// e.g. oauth.google.client_secret -> oauth-google-client-secret
+func (f Field) Flag() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(f.Key)
+}
+
+// Get returns the value of the field in conf, secrets are never revealed
+func (f Field) Get(conf *Config) string {
+	return f.get(conf)
+}
+
+func stringField(key, usage string, ptr func(c *Config) *string) Field {
+	return Field{Key: key, Usage: usage,
+		get: func(c *Config) string { return *ptr(c) },
+		set: func(c *Config, value string) error {
+			*ptr(c) = value
+			return nil
+		},
+	}
+}
+
+func secretField(key, usage string, ptr func(c *Config) *Secret) Field {
+	return Field{Key: key, Usage: usage, Secret: true,
+		get: func(c *Config) string { return ptr(c).String() },
+		set: func(c *Config, value string) error {
+			*ptr(c) = Secret(value)
+			return nil
+		},
+	}
+}
+
+func intField(key, usage string, ptr func(c *Config) *int) Field {
+	return Field{Key: key, Usage: usage,
+		get: func(c *Config) string { return strconv.Itoa(*ptr(c)) },
+		set: func(c *Config, value string) (err error) {
+			*ptr(c), err = strconv.Atoi(value)
+			return
+		},
+	}
+}
+
+func boolField(key, usage string, ptr func(c *Config) *bool) Field {
+	return Field{Key: key, Usage: usage,
+		get: func(c *Config) string { return strconv.FormatBool(*ptr(c)) },
+		set: func(c *Config, value string) (err error) {
+			*ptr(c), err = strconv.ParseBool(value)
+			return
+		},
+	}
+}
+
+// listField is a comma-separated list of strings
+func listField(key, usage string, ptr func(c *Config) *[]string) Field {
+	return Field{Key: key, Usage: usage,
+		get: func(c *Config) string { return strings.Join(*ptr(c), ",") },
+		set: func(c *Config, value string) error {
+			var list []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			*ptr(c) = list
+			return nil
+		},
+	}
+}
+
+func durationField(key, usage string, ptr func(c *Config) *Duration) Field {
+	return Field{Key: key, Usage: usage,
+		get: func(c *Config) string { return ptr(c).String() },
+		set: func(c *Config, value string) error { return ptr(c).UnmarshalText([]byte(value)) },
+	}
+}
+
+var fields = []Field{
+	intField("port", "The port to listen to",
+		func(c *Config) *int { return &c.Port }),
+	stringField("coniksserver_addr", "The address of the ConiksServer (tcp://host:port)",
+		func(c *Config) *string { return &c.ConiksServerAddr }),
+	stringField("keyserver_path", "The directory of the key server database",
+		func(c *Config) *string { return &c.KeyServerPath }),
+	stringField("botstorage_addr", "The address of the BotStorage",
+		func(c *Config) *string { return &c.BotStorageAddr }),
+	listField("allowed_origins", "The comma-separated list of the CORS allowed origins",
+		func(c *Config) *[]string { return &c.AllowedOrigins }),
+	stringField("keyfile", "The key file (HMAC with SHA256 used for JWT signing) to load",
+		func(c *Config) *string { return &c.KeyFile }),
+	secretField("key", "The base64 encoded JWT signing key, takes precedence over the key file",
+		func(c *Config) *Secret { return &c.Key }),
+	durationField("server.read_timeout", "The maximum duration for reading an entire request",
+		func(c *Config) *Duration { return &c.Server.ReadTimeout }),
+	durationField("server.write_timeout", "The maximum duration before timing out the writes of a response",
+		func(c *Config) *Duration { return &c.Server.WriteTimeout }),
+	durationField("server.idle_timeout", "The maximum duration to wait for the next request on a keep-alive connection",
+		func(c *Config) *Duration { return &c.Server.IdleTimeout }),
+	durationField("server.shutdown_timeout", "The maximum duration to wait for the in-flight requests on shutdown",
+		func(c *Config) *Duration { return &c.Server.ShutdownTimeout }),
+	stringField("tls.cert_file", "The TLS certificate file (PEM), HTTPS is served when it is set",
+		func(c *Config) *string { return &c.TLS.CertFile }),
+	stringField("tls.key_file", "The TLS private key file (PEM)",
+		func(c *Config) *string { return &c.TLS.KeyFile }),
+	stringField("tls.min_version", "The minimum TLS version: 1.0, 1.1, 1.2 or 1.3",
+		func(c *Config) *string { return &c.TLS.MinVersion }),
+	stringField("tls.cipher_policy", "The TLS cipher policy: default (Go defaults) or modern (forward secrecy and AEAD only)",
+		func(c *Config) *string { return &c.TLS.CipherPolicy }),
+	stringField("tls.client_ca_file", "The CA file (PEM) used to verify the client certificates of the bots",
+		func(c *Config) *string { return &c.TLS.ClientCAFile }),
+	stringField("metrics.path", "The path of the Prometheus metrics endpoint, empty to disable it",
+		func(c *Config) *string { return &c.Metrics.Path }),
+	stringField("metrics.addr", "The address (host:port) of a separate admin listener serving the metrics, the main listener is used when empty",
+		func(c *Config) *string { return &c.Metrics.Addr }),
+	stringField("admin.addr", "The address (host:port) of the admin API listener, empty to disable the admin API",
+		func(c *Config) *string { return &c.Admin.Addr }),
+	stringField("admin.client_ca_file", "The CA file (PEM) used to verify the client certificates of the admins, requires TLS",
+		func(c *Config) *string { return &c.Admin.ClientCAFile }),
+	stringField("log.level", "The log level: debug, info, warn or error",
+		func(c *Config) *string { return &c.Log.Level }),
+	stringField("log.format", "The log format: logfmt or json",
+		func(c *Config) *string { return &c.Log.Format }),
+	boolField("log.redact", "Redact the sensitive values (tokens, secrets, keys) from the logs",
+		func(c *Config) *bool { return &c.Log.Redact }),
+	stringField("audit.file", "The hash-chained audit log file, empty to disable the audit log",
+		func(c *Config) *string { return &c.Audit.File }),
+	durationField("health.check_timeout", "The timeout of each dependency check of the readiness endpoint",
+		func(c *Config) *Duration { return &c.Health.CheckTimeout }),
+	boolField("ratelimit.enabled", "Enable the rate limiting of the auth, key server and Coniks routes",
+		func(c *Config) *bool { return &c.RateLimit.Enabled }),
+	boolField("ratelimit.trust_proxy_headers", "Take the client IP from the X-Forwarded-For header set by a trusted reverse proxy",
+		func(c *Config) *bool { return &c.RateLimit.TrustProxyHeaders }),
+	intField("ratelimit.trusted_proxy_hops", "The number of trusted reverse proxies, each appends an entry to X-Forwarded-For",
+		func(c *Config) *int { return &c.RateLimit.TrustedProxyHops }),
+	intField("body_limits.auth", "The maximum request body size in bytes on the auth routes",
+		func(c *Config) *int { return &c.BodyLimits.Auth }),
+	intField("body_limits.public_key", "The maximum request body size in bytes on the key server routes",
+		func(c *Config) *int { return &c.BodyLimits.PublicKey }),
+	intField("body_limits.coniks", "The maximum request body size in bytes on the Coniks route",
+		func(c *Config) *int { return &c.BodyLimits.Coniks }),
+	durationField("public_key.challenge_ttl", "How long a proof-of-possession challenge can be answered",
+		func(c *Config) *Duration { return &c.PublicKey.ChallengeTTL }),
+	intField("public_key.max_one_time_prekeys", "The maximum number of one-time prekeys stored per device",
+		func(c *Config) *int { return &c.PublicKey.MaxOneTimePrekeys }),
+	intField("public_key.prekey_low_watermark", "The number of one-time prekeys below which the owner is warned to replenish them",
+		func(c *Config) *int { return &c.PublicKey.PrekeyLowWatermark }),
+	durationField("public_key.max_key_lifetime", "The maximum lifetime of a device key, 0 for no limit",
+		func(c *Config) *Duration { return &c.PublicKey.MaxKeyLifetime }),
+	durationField("public_key.expiry_warning", "How long before a device key expires its owner is warned to rotate it",
+		func(c *Config) *Duration { return &c.PublicKey.ExpiryWarning }),
+	stringField("public_key.expired_keys", "What the GET endpoints do with the expired keys: hide or flag",
+		func(c *Config) *string { return &c.PublicKey.ExpiredKeys }),
+	durationField("public_key.purge_interval", "The interval between two purges of the expired keys, 0 to disable the purge",
+		func(c *Config) *Duration { return &c.PublicKey.PurgeInterval }),
+	boolField("public_key.archive_expired_keys", "Archive the purged expired keys instead of deleting them",
+		func(c *Config) *bool { return &c.PublicKey.ArchiveExpiredKeys }),
+	intField("public_key.max_lookup_batch", "The maximum number of logins and devices asked for in a batch lookup",
+		func(c *Config) *int { return &c.PublicKey.MaxLookupBatch }),
+	durationField("public_key.events_heartbeat", "The interval of the heartbeats keeping the key event streams open",
+		func(c *Config) *Duration { return &c.PublicKey.EventsHeartbeat }),
+	durationField("public_key.change_retention", "How long the key changes can be replayed by the event streams, 0 to keep them all",
+		func(c *Config) *Duration { return &c.PublicKey.ChangeRetention }),
+	{Key: "webhooks.subscriptions", Usage: "The webhook subscriptions, as a JSON array of {\"url\", \"secret\", \"events\"} objects", Secret: true,
+		get: func(c *Config) string {
+			if len(c.Webhooks.Subscriptions) == 0 {
+				return ""
+			}
+			return fmt.Sprint(c.Webhooks.Subscriptions)
+		},
+		set: func(c *Config, value string) error { return json.Unmarshal([]byte(value), &c.Webhooks.Subscriptions) },
+	},
+	durationField("webhooks.timeout", "The timeout of a webhook delivery",
+		func(c *Config) *Duration { return &c.Webhooks.Timeout }),
+	intField("webhooks.max_attempts", "The number of attempts of a webhook delivery before it is dead-lettered",
+		func(c *Config) *int { return &c.Webhooks.MaxAttempts }),
+	durationField("webhooks.initial_backoff", "The delay before the first retry of a webhook delivery, doubled after each attempt",
+		func(c *Config) *Duration { return &c.Webhooks.InitialBackoff }),
+	durationField("webhooks.max_backoff", "The maximum delay between two attempts of a webhook delivery",
+		func(c *Config) *Duration { return &c.Webhooks.MaxBackoff }),
+	{Key: "roles.rules", Usage: "The rules granting roles, as a JSON array of {\"role\", \"logins\", \"github_orgs\", \"google_domains\"} objects",
+		get: func(c *Config) string {
+			if len(c.Roles.Rules) == 0 {
+				return ""
+			}
+			return fmt.Sprint(c.Roles.Rules)
+		},
+		set: func(c *Config, value string) error { return json.Unmarshal([]byte(value), &c.Roles.Rules) },
+	},
+	durationField("oauth.client_token_ttl", "The lifetime of the JWTs issued to the service clients",
+		func(c *Config) *Duration { return &c.OauthPrefs.ClientTokenTTL }),
+	{Key: "oauth.clients", Usage: "The service clients, as a JSON array of {\"client_id\", \"client_secret_hash\", \"scopes\"} objects",
+		get: func(c *Config) string {
+			if len(c.OauthPrefs.Clients) == 0 {
+				return ""
+			}
+			return fmt.Sprint(c.OauthPrefs.Clients)
+		},
+		set: func(c *Config, value string) error { return json.Unmarshal([]byte(value), &c.OauthPrefs.Clients) },
+	},
+	secretField("oauth.google.client_secret", "The Google OAUTH client secret",
+		func(c *Config) *Secret { return &c.OauthPrefs.GooglePrefs.ClientSecret }),
+	stringField("oauth.google.client_secret_file", "The file containing the Google OAUTH client secret",
+		func(c *Config) *string { return &c.OauthPrefs.GooglePrefs.ClientSecretFile }),
+	secretField("oauth.github.client_secret", "The Github OAUTH client secret",
+		func(c *Config) *Secret { return &c.OauthPrefs.GithubPrefs.ClientSecret }),
+	stringField("oauth.github.client_secret_file", "The file containing the Github OAUTH client secret",
+		func(c *Config) *string { return &c.OauthPrefs.GithubPrefs.ClientSecretFile }),
+}
+
+func init() {
+	fields = append(fields, rateLimitPolicyFields("auth", "the auth routes", func(c *Config) *RateLimitPolicy { return &c.RateLimit.Auth })...)
+	fields = append(fields, rateLimitPolicyFields("public_key", "the key server routes", func(c *Config) *RateLimitPolicy { return &c.RateLimit.PublicKey })...)
+	fields = append(fields, rateLimitPolicyFields("coniks", "the Coniks route", func(c *Config) *RateLimitPolicy { return &c.RateLimit.Coniks })...)
+}
+
+// rateLimitPolicyFields returns the fields of the rate limiting policy of a route group
+func rateLimitPolicyFields(group, routes string, ptr func(c *Config) *RateLimitPolicy) []Field {
+	prefix := "ratelimit." + group + "."
+	return []Field{
+		intField(prefix+"requests", fmt.Sprintf("The number of requests allowed per period on %s", routes),
+			func(c *Config) *int { return &ptr(c).Requests }),
+		durationField(prefix+"period", fmt.Sprintf("The rate limiting period of %s", routes),
+			func(c *Config) *Duration { return &ptr(c).Period }),
+		intField(prefix+"burst", fmt.Sprintf("The maximal burst of requests on %s", routes),
+			func(c *Config) *int { return &ptr(c).Burst }),
+		stringField(prefix+"key", fmt.Sprintf("What the requests on %s are limited by: ip, login or both", routes),
+			func(c *Config) *string { return &ptr(c).Key }),
+	}
+}
+
+// Fields returns all the configuration fields
+func Fields() []Field {
+	return fields
+}
+
+func lookupField(key string) (Field, bool) {
+	for _, f := range fields {
+		if f.Key == key {
+			return f, true
+		}
+	}
+	return Field{}, false
+}
+
+// EnvName returns the name of the environment variable associated to a TOML key
+// e.g. oauth.google.client_secret -> MUTE_AUTH_PROXY_OAUTH_GOOGLE_CLIENT_SECRET
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// Source returns where the field denoted by its TOML key has been loaded from
+func (conf *Config) Source(key string) string {
+	if source, ok := conf.sources[key]; ok {
+		return source
+	}
+	return "default"
+}
+
+// Entries returns the effective configuration, secrets are never revealed
+func (conf *Config) Entries() []Entry {
+	entries := make([]Entry, 0, len(fields))
+	for _, f := range fields {
+		value := f.get(conf)
+		if f.Secret && value != "" {
+			value = "***"
+		}
+		entries = append(entries, Entry{Key: f.Key, Value: value, Source: conf.Source(f.Key)})
+	}
+	return entries
+}
@@ -0,0 +1,382 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// minKeyLength is the minimal length in bytes of the JWT signing key (HMAC with SHA256)
+const minKeyLength = 32
+
+// FieldError is a problem found on a configuration field, denoted by its TOML path
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidationError gathers all the problems found in a configuration
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	problems := make([]string, len(e))
+	for i, fieldErr := range e {
+		problems[i] = fmt.Sprintf("  - %s", fieldErr)
+	}
+	return fmt.Sprintf("Invalid configuration, %d problem(s) found:\n%s", len(e), strings.Join(problems, "\n"))
+}
+
+func (e *ValidationError) add(field, format string, args ...interface{}) {
+	*e = append(*e, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Vocabulary lists the accepted values of the settings whose meaning is defined by the other packages.
+// The callers of Validate give it, so that the config package doesn't depend on them.
+type Vocabulary struct {
+	LogLevels      []string
+	LogFormats     []string
+	TLSVersions    []string
+	CipherPolicies []string
+	Roles          []string
+	Events         []string // the audited events, the webhooks subscribe to them
+}
+
+// Validate checks the whole configuration and reports all the problems at once.
+// The returned error is a ValidationError, or nil if the configuration is valid.
+func (conf *Config) Validate(vocab Vocabulary) error {
+	var errs ValidationError
+
+	if conf.Port <= 0 || conf.Port > 65535 {
+		errs.add("port", "must be between 1 and 65535, got %d", conf.Port)
+	}
+	if strings.TrimSpace(conf.KeyServerPath) == "" {
+		errs.add("keyserver_path", "must not be empty")
+	}
+	validateAddr(&errs, "coniksserver_addr", conf.ConiksServerAddr, "tcp", "tcp4", "tcp6")
+	validateAddr(&errs, "botstorage_addr", conf.BotStorageAddr, "http", "https")
+	if loopsBack(conf.BotStorageAddr, conf.Port) {
+		errs.add("botstorage_addr", "%q is the proxy itself, the /botstorage requests would be proxied in a loop", conf.BotStorageAddr)
+	}
+	for i, origin := range conf.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			errs.add(fmt.Sprintf("allowed_origins[%d]", i), "%q is not an origin such as https://coedit.re", origin)
+		}
+	}
+	if key, err := conf.SigningKey(); err != nil {
+		if conf.Key.IsSet() {
+			errs.add("key", "%s", err)
+		} else {
+			errs.add("keyfile", "%s", err)
+		}
+	} else if len(key) < minKeyLength {
+		errs.add("key", "the signing key must be at least %d bytes long, got %d", minKeyLength, len(key))
+	}
+
+	for _, timeout := range []struct {
+		field string
+		value Duration
+	}{
+		{"server.read_timeout", conf.Server.ReadTimeout},
+		{"server.write_timeout", conf.Server.WriteTimeout},
+		{"server.idle_timeout", conf.Server.IdleTimeout},
+		{"server.shutdown_timeout", conf.Server.ShutdownTimeout},
+		{"health.check_timeout", conf.Health.CheckTimeout},
+		{"public_key.challenge_ttl", conf.PublicKey.ChallengeTTL},
+		{"public_key.events_heartbeat", conf.PublicKey.EventsHeartbeat},
+		{"webhooks.timeout", conf.Webhooks.Timeout},
+		{"webhooks.initial_backoff", conf.Webhooks.InitialBackoff},
+	} {
+		if timeout.value.Duration <= 0 {
+			errs.add(timeout.field, "must be a positive duration, got %s", timeout.value)
+		}
+	}
+	validateTLS(&errs, conf.TLS, vocab)
+	if conf.Metrics.Path != "" && !strings.HasPrefix(conf.Metrics.Path, "/") {
+		errs.add("metrics.path", "must start with /, got %q", conf.Metrics.Path)
+	}
+	if conf.Metrics.Addr != "" {
+		if _, _, err := net.SplitHostPort(conf.Metrics.Addr); err != nil {
+			errs.add("metrics.addr", "must be host:port such as localhost:9100: %s", err)
+		} else if conf.Metrics.Path == "" {
+			errs.add("metrics.path", "must be set when metrics.addr is set")
+		}
+	}
+	validateAdmin(&errs, conf)
+	validateChoice(&errs, "log.level", conf.Log.Level, vocab.LogLevels)
+	validateChoice(&errs, "log.format", conf.Log.Format, vocab.LogFormats)
+	for _, policy := range []struct {
+		group  string
+		policy RateLimitPolicy
+	}{
+		{"auth", conf.RateLimit.Auth},
+		{"public_key", conf.RateLimit.PublicKey},
+		{"coniks", conf.RateLimit.Coniks},
+	} {
+		validateRateLimitPolicy(&errs, "ratelimit."+policy.group, policy.policy)
+	}
+	if conf.RateLimit.TrustProxyHeaders && conf.RateLimit.TrustedProxyHops <= 0 {
+		errs.add("ratelimit.trusted_proxy_hops", "must be positive when trust_proxy_headers is set, got %d", conf.RateLimit.TrustedProxyHops)
+	}
+	for _, limit := range []struct {
+		field string
+		value int
+	}{
+		{"body_limits.auth", conf.BodyLimits.Auth},
+		{"body_limits.public_key", conf.BodyLimits.PublicKey},
+		{"body_limits.coniks", conf.BodyLimits.Coniks},
+	} {
+		if limit.value <= 0 {
+			errs.add(limit.field, "must be a positive number of bytes, got %d", limit.value)
+		}
+	}
+	if conf.PublicKey.MaxOneTimePrekeys <= 0 {
+		errs.add("public_key.max_one_time_prekeys", "must be positive, got %d", conf.PublicKey.MaxOneTimePrekeys)
+	}
+	if conf.PublicKey.PrekeyLowWatermark < 0 || conf.PublicKey.PrekeyLowWatermark > conf.PublicKey.MaxOneTimePrekeys {
+		errs.add("public_key.prekey_low_watermark", "must be between 0 and max_one_time_prekeys (%d), got %d", conf.PublicKey.MaxOneTimePrekeys, conf.PublicKey.PrekeyLowWatermark)
+	}
+	if conf.PublicKey.MaxLookupBatch <= 0 {
+		errs.add("public_key.max_lookup_batch", "must be positive, got %d", conf.PublicKey.MaxLookupBatch)
+	}
+	for _, duration := range []struct {
+		field string
+		value Duration
+	}{
+		{"public_key.max_key_lifetime", conf.PublicKey.MaxKeyLifetime},
+		{"public_key.expiry_warning", conf.PublicKey.ExpiryWarning},
+		{"public_key.purge_interval", conf.PublicKey.PurgeInterval},
+		{"public_key.change_retention", conf.PublicKey.ChangeRetention},
+	} {
+		if duration.value.Duration < 0 {
+			errs.add(duration.field, "must not be negative, got %s", duration.value)
+		}
+	}
+	if conf.PublicKey.ExpiredKeys != "hide" && conf.PublicKey.ExpiredKeys != "flag" {
+		errs.add("public_key.expired_keys", "must be hide or flag, got %q", conf.PublicKey.ExpiredKeys)
+	}
+	validateWebhooks(&errs, conf.Webhooks, vocab.Events)
+	validateRoles(&errs, conf.Roles, vocab.Roles)
+	if conf.OauthPrefs.ClientTokenTTL.Duration <= 0 {
+		errs.add("oauth.client_token_ttl", "must be a positive duration, got %s", conf.OauthPrefs.ClientTokenTTL)
+	}
+	ids := make(map[string]bool)
+	for i, client := range conf.OauthPrefs.Clients {
+		path := fmt.Sprintf("oauth.clients[%d]", i)
+		if client.ID == "" {
+			errs.add(path+".client_id", "must not be empty")
+		} else if ids[client.ID] {
+			errs.add(path+".client_id", "%q is registered more than once", client.ID)
+		}
+		ids[client.ID] = true
+		if _, err := bcrypt.Cost([]byte(client.SecretHash)); err != nil {
+			errs.add(path+".client_secret_hash", "must be a bcrypt hash as printed by generate-client: %s", err)
+		}
+		if len(client.Scopes) == 0 {
+			errs.add(path+".scopes", "must contain at least one scope")
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateAddr checks that addr is an URL with one of the given schemes and a host
+func validateAddr(errs *ValidationError, field, addr string, schemes ...string) {
+	if addr == "" {
+		errs.add(field, "must not be empty")
+		return
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		errs.add(field, "%s", err)
+		return
+	}
+	validScheme := false
+	for _, scheme := range schemes {
+		validScheme = validScheme || u.Scheme == scheme
+	}
+	if !validScheme {
+		errs.add(field, "the scheme of %q must be one of %s", addr, strings.Join(schemes, ", "))
+	}
+	if u.Host == "" {
+		errs.add(field, "%q has no host", addr)
+	} else if _, _, err := net.SplitHostPort(u.Host); err != nil && u.Scheme != "http" && u.Scheme != "https" {
+		errs.add(field, "%q has no port", addr)
+	}
+}
+
+// loopsBack returns true if the HTTP address is a loopback address on the port of the proxy
+func loopsBack(addr string, port int) bool {
+	u, err := url.Parse(addr)
+	if err != nil || u.Port() != fmt.Sprint(port) {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
+
+func validateRateLimitPolicy(errs *ValidationError, path string, policy RateLimitPolicy) {
+	if policy.Requests <= 0 {
+		errs.add(path+".requests", "must be positive, got %d", policy.Requests)
+	}
+	if policy.Period.Duration <= 0 {
+		errs.add(path+".period", "must be a positive duration, got %s", policy.Period)
+	}
+	if policy.Burst <= 0 {
+		errs.add(path+".burst", "must be positive, got %d", policy.Burst)
+	}
+	if policy.Key != "ip" && policy.Key != "login" && policy.Key != "both" {
+		errs.add(path+".key", "must be ip, login or both, got %q", policy.Key)
+	}
+}
+
+func validateRoles(errs *ValidationError, conf RolesConfig, roles []string) {
+	for i, rule := range conf.Rules {
+		path := fmt.Sprintf("roles.rules[%d]", i)
+		validateChoice(errs, path+".role", rule.Role, roles)
+		if len(rule.Logins)+len(rule.GithubOrgs)+len(rule.GoogleDomains) == 0 {
+			errs.add(path, "must match logins, github_orgs or google_domains")
+		}
+		for _, values := range []struct {
+			field  string
+			values []string
+		}{
+			{"logins", rule.Logins},
+			{"github_orgs", rule.GithubOrgs},
+			{"google_domains", rule.GoogleDomains},
+		} {
+			for _, value := range values.values {
+				if strings.TrimSpace(value) == "" {
+					errs.add(path+"."+values.field, "must not contain empty values")
+				}
+			}
+		}
+	}
+}
+
+func validateWebhooks(errs *ValidationError, conf WebhooksConfig, events []string) {
+	if conf.MaxAttempts <= 0 {
+		errs.add("webhooks.max_attempts", "must be positive, got %d", conf.MaxAttempts)
+	}
+	if conf.MaxBackoff.Duration < conf.InitialBackoff.Duration {
+		errs.add("webhooks.max_backoff", "must not be shorter than initial_backoff (%s), got %s", conf.InitialBackoff, conf.MaxBackoff)
+	}
+	urls := make(map[string]bool)
+	for i, sub := range conf.Subscriptions {
+		path := fmt.Sprintf("webhooks.subscriptions[%d]", i)
+		validateAddr(errs, path+".url", sub.URL, "http", "https")
+		if urls[sub.URL] {
+			errs.add(path+".url", "%q is subscribed more than once", sub.URL)
+		}
+		urls[sub.URL] = true
+		if len(sub.Secret) < minKeyLength {
+			errs.add(path+".secret", "must be at least %d bytes long, got %d", minKeyLength, len(sub.Secret))
+		}
+		if len(sub.Events) == 0 {
+			errs.add(path+".events", "must contain at least one event")
+		}
+		for _, event := range sub.Events {
+			if !contains(events, event) {
+				errs.add(path+".events", "%q is not one of %s", event, strings.Join(events, ", "))
+			}
+		}
+	}
+}
+
+func validateAdmin(errs *ValidationError, conf *Config) {
+	if conf.Admin.Addr == "" {
+		if conf.Admin.ClientCAFile != "" {
+			errs.add("admin.addr", "must be set when admin.client_ca_file is set")
+		}
+		return
+	}
+	if _, _, err := net.SplitHostPort(conf.Admin.Addr); err != nil {
+		errs.add("admin.addr", "must be host:port such as localhost:9102: %s", err)
+	} else if conf.Admin.Addr == conf.Metrics.Addr {
+		errs.add("admin.addr", "must differ from metrics.addr")
+	}
+	if conf.Admin.ClientCAFile != "" {
+		if !conf.TLS.Enabled() {
+			errs.add("admin.client_ca_file", "requires TLS, tls.cert_file must be set")
+		} else if _, err := os.Stat(conf.Admin.ClientCAFile); err != nil {
+			errs.add("admin.client_ca_file", "%s", err)
+		}
+	}
+}
+
+func validateTLS(errs *ValidationError, conf TLSConfig, vocab Vocabulary) {
+	if !conf.Enabled() {
+		if conf.KeyFile != "" || conf.ClientCAFile != "" {
+			errs.add("tls.cert_file", "must be set when tls.key_file or tls.client_ca_file is set")
+		}
+		return
+	}
+	if conf.KeyFile == "" {
+		errs.add("tls.key_file", "must be set when tls.cert_file is set")
+	}
+	for _, file := range []struct{ field, path string }{
+		{"tls.cert_file", conf.CertFile},
+		{"tls.key_file", conf.KeyFile},
+		{"tls.client_ca_file", conf.ClientCAFile},
+	} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			errs.add(file.field, "%s", err)
+		}
+	}
+	validateChoice(errs, "tls.min_version", conf.MinVersion, vocab.TLSVersions)
+	validateChoice(errs, "tls.cipher_policy", conf.CipherPolicy, vocab.CipherPolicies)
+}
+
+// validateChoice checks that the value is one of the accepted ones
+func validateChoice(errs *ValidationError, field, value string, accepted []string) {
+	if !contains(accepted, value) {
+		errs.add(field, "must be one of %s, got %q", strings.Join(accepted, ", "), value)
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// the accepted values are the ones given by the caller, not the ones of the runtime packages
+var testVocabulary = Vocabulary{
+	LogLevels:      []string{"info"},
+	LogFormats:     []string{"logfmt"},
+	TLSVersions:    []string{"1.2"},
+	CipherPolicies: []string{"modern"},
+	Roles:          []string{"user"},
+	Events:         []string{"login"},
+}
+
+func TestValidateFieldPaths(t *testing.T) {
+	tests := []struct {
+		name       string
+		change     func(c *Config)
+		wantFields []string
+	}{
+		{"default", func(c *Config) {}, nil},
+		{"value outside the vocabulary", func(c *Config) { c.Log.Level, c.Log.Format = "debug", "json" }, []string{"log.level", "log.format"}},
+		{"untrusted proxy hops", func(c *Config) { c.RateLimit.TrustProxyHeaders, c.RateLimit.TrustedProxyHops = true, 0 }, []string{"ratelimit.trusted_proxy_hops"}},
+		{"role rule", func(c *Config) { c.Roles.Rules = []RoleRule{{Role: "admin"}} }, []string{"roles.rules[0].role", "roles.rules[0]"}},
+		{"second subscription", func(c *Config) {
+			c.Webhooks.Subscriptions = []WebhookSubscription{
+				{URL: "https://hooks.example/a", Secret: Secret(strings.Repeat("s", minKeyLength)), Events: []string{"login"}},
+				{URL: "https://hooks.example/b", Secret: "short", Events: []string{"logout"}},
+			}
+		}, []string{"webhooks.subscriptions[1].secret", "webhooks.subscriptions[1].events"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := Default()
+			conf.Key = Secret(base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", minKeyLength))))
+			tt.change(conf)
+			var fields []string
+			if err := conf.Validate(testVocabulary); err != nil {
+				for _, fieldErr := range err.(ValidationError) {
+					fields = append(fields, fieldErr.Field)
+				}
+			}
+			if !reflect.DeepEqual(fields, tt.wantFields) {
+				t.Errorf("invalid fields %v, want %v", fields, tt.wantFields)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package helper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// BodyError is a request body that is too large or can't be decoded
+type BodyError struct {
+	Status int // 413 or 400
+	Detail string
+}
+
+func (e *BodyError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Detail)
+}
+
+// ToProblem returns the problem response of the error
+func (e *BodyError) ToProblem() Problem {
+	if e.Status == http.StatusRequestEntityTooLarge {
+		return NewProblem(e.Status, ProblemBodyTooLarge, e.Detail)
+	}
+	return NewProblem(e.Status, ProblemInvalidBody, e.Detail)
+}
+
+// limitedBody counts the bytes read through http.MaxBytesReader, to tell a body that is too large
+// from the other read errors
+type limitedBody struct {
+	io.ReadCloser
+	max  int64
+	read int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+func (b *limitedBody) tooLarge(err error) bool {
+	return err != nil && err != io.EOF && b.read >= b.max
+}
+
+func limitBody(w http.ResponseWriter, r *http.Request, max int64) *limitedBody {
+	body := &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, max), max: max}
+	r.Body = body
+	return body
+}
+
+func tooLargeError(max int64) *BodyError {
+	return &BodyError{http.StatusRequestEntityTooLarge, fmt.Sprintf("The request body must not exceed %d bytes.", max)}
+}
+
+// ParseForm parses the form of the request, whose body must not exceed max bytes
+func ParseForm(w http.ResponseWriter, r *http.Request, max int64) error {
+	if r.Body == nil {
+		return r.ParseForm()
+	}
+	body := limitBody(w, r, max)
+	err := r.ParseForm()
+	if body.tooLarge(err) {
+		return tooLargeError(max)
+	} else if err != nil {
+		return &BodyError{http.StatusBadRequest, fmt.Sprintf("Couldn't parse the request's form: %s", err)}
+	}
+	return nil
+}
+
+// ReadBody reads the whole request body, which must not exceed max bytes
+func ReadBody(w http.ResponseWriter, r *http.Request, max int64) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	body := limitBody(w, r, max)
+	data, err := ioutil.ReadAll(body)
+	if body.tooLarge(err) {
+		return nil, tooLargeError(max)
+	} else if err != nil {
+		return nil, &BodyError{http.StatusBadRequest, fmt.Sprintf("Couldn't read the request body: %s", err)}
+	}
+	return data, nil
+}
+
+// DecodeJSON decodes the request body, which must not exceed max bytes, into v.
+// Unknown fields and data after the JSON value are rejected.
+func DecodeJSON(w http.ResponseWriter, r *http.Request, max int64, v interface{}) error {
+	if r.Body == nil {
+		return &BodyError{http.StatusBadRequest, "The request body is empty."}
+	}
+	body := limitBody(w, r, max)
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if body.tooLarge(err) {
+		return tooLargeError(max)
+	} else if err == io.EOF {
+		return &BodyError{http.StatusBadRequest, "The request body is empty."}
+	} else if err != nil {
+		return &BodyError{http.StatusBadRequest, fmt.Sprintf("The request body is not valid JSON: %s", err)}
+	}
+	var trailing json.RawMessage
+	err = dec.Decode(&trailing)
+	if body.tooLarge(err) {
+		return tooLargeError(max)
+	} else if err != io.EOF {
+		return &BodyError{http.StatusBadRequest, "The request body must contain a single JSON value."}
+	}
+	return nil
+}
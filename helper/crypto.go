@@ -37,6 +37,11 @@ func GetSecret() []byte {
 	return sec.secret
 }
 
+// HasSecret returns true if the secret has been set, unlike GetSecret it never exits
+func HasSecret() bool {
+	return sec.setCounter == 1 && len(sec.secret) > 0
+}
+
 // GenerateSecret sets the secret by generating a new one
 // The secret can only be set once...
 func GenerateSecret() {
@@ -19,10 +19,11 @@ package helper
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 	"regexp"
 	"strings"
+
+	"github.com/coast-team/mute-auth-proxy/logging"
 )
 
 var allowedOrigins = []string{"127.0.0.1", "localhost", "dev.coedit.re", "coedit.re"}
@@ -45,6 +46,6 @@ func SetHeader(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Headers", "content-type, authorization") // IMPORTANT !
 		w.Header().Set("Connection", "keep-alive")
 	} else {
-		log.Printf("CORS: origin '%s' not allowed!", origin)
+		logging.Log.WithField("origin", origin).Warn("CORS: origin not allowed")
 	}
 }
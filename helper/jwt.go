@@ -18,10 +18,15 @@
 package helper
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"log"
 	"net/http"
+	"strings"
+	"sync"
 
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/coast-team/mute-auth-proxy/metrics"
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/dgrijalva/jwt-go/request"
 )
@@ -33,6 +38,25 @@ func ExtractJWT(r *http.Request) (*jwt.Token, error) {
 	return token, err
 }
 
+// Authenticate returns the identity of the client as a token: the JWT of the Authorization header or,
+// if there is none, the TLS client certificate verified against the client CA (mTLS for bots).
+// For a client certificate, the token has the bot claims with the certificate common name as login.
+func Authenticate(r *http.Request) (*jwt.Token, error) {
+	if r.Header.Get("Authorization") == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		if cert.Subject.CommonName != "" {
+			token := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{
+				"provider": "bot",
+				"login":    cert.Subject.CommonName,
+				"auth":     "mtls",
+			})
+			token.Valid = true
+			return token, nil
+		}
+	}
+	return ExtractJWT(r)
+}
+
 func jwtKeyFunc(token *jwt.Token) (interface{}, error) {
 	// Don't forget to validate the alg is what you expect:
 	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -42,30 +66,117 @@ func jwtKeyFunc(token *jwt.Token) (interface{}, error) {
 	return GetSecret(), nil
 }
 
-// IsJWTValid checks that the token is a well formed and not expired JWT
+// JWTError is a JWT validation failure. Reason is malformed, expired, invalid or missing.
+type JWTError struct {
+	Reason string
+	msg    string
+	err    error
+}
+
+func (e *JWTError) Error() string {
+	return fmt.Sprintf("%s: %s", e.msg, e.err)
+}
+
+// IsJWTValid checks that the token is a well formed and not expired JWT.
+// The returned error is a *JWTError, or nil if the token is valid.
 func IsJWTValid(token *jwt.Token, tokenError error) error {
-	var msg string
+	var msg, reason string
 	if token != nil && token.Valid {
-		log.Println("JWT is Valid")
+		logging.Log.Debug("JWT is valid")
 		return nil
 	} else if ve, ok := tokenError.(*jwt.ValidationError); ok {
 		if ve.Errors&jwt.ValidationErrorMalformed != 0 {
-			msg = "That's not even a JWT"
+			msg, reason = "That's not even a JWT", "malformed"
 		} else if ve.Errors&(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0 {
-			msg = "Token is either expired or not active yet"
+			msg, reason = "Token is either expired or not active yet", "expired"
 		} else {
-			msg = "Couldn't handle this token"
+			msg, reason = "Couldn't handle this token", "invalid"
 		}
+	} else if tokenError == request.ErrNoTokenInRequest {
+		msg, reason = "Couldn't handle this token", "missing"
 	} else {
-		msg = "Couldn't handle this token"
+		msg, reason = "Couldn't handle this token", "invalid"
 	}
-	return fmt.Errorf("%s: %s", msg, tokenError)
+	metrics.JWTValidationFailure(reason)
+	return &JWTError{Reason: reason, msg: msg, err: tokenError}
 }
 
+// HasScope checks that the token grants the given scope.
+// Tokens without a scope claim (users and legacy bots) are not restricted.
+func HasScope(token *jwt.Token, scope string) bool {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return false
+	}
+	scopes, ok := claims["scope"].(string)
+	if !ok {
+		return true
+	}
+	return StringInSlice(scope, strings.Fields(scopes))
+}
+
+// GenerateJWT returns a new token with a random ID (jti claim), so that it can be revoked
 func GenerateJWT() *jwt.Token {
-	return jwt.New(jwt.SigningMethodHS256)
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		logging.Log.WithError(err).Fatal("Couldn't generate a token ID")
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"jti": hex.EncodeToString(id)})
 }
 
 func GetSignedString(token *jwt.Token) (string, error) {
 	return token.SignedString(GetSecret())
 }
+
+// The roles granted by the tokens, listed in their space-separated roles claim
+const (
+	RolesClaim  = "roles"
+	RoleUser    = "user"
+	RoleAdmin   = "admin"
+	RoleBot     = "bot"
+	RoleAuditor = "auditor"
+)
+
+// Roles lists the roles
+var Roles = []string{RoleUser, RoleAdmin, RoleBot, RoleAuditor}
+
+// TokenRoles returns the roles granted by the token. The tokens issued without roles claim have the bot
+// role for the bots and the service clients, the user role otherwise.
+func TokenRoles(token *jwt.Token) []string {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil
+	}
+	if roles, ok := claims[RolesClaim].(string); ok {
+		return strings.Fields(roles)
+	}
+	switch claims["provider"] {
+	case "bot", "client":
+		return []string{RoleBot}
+	}
+	return []string{RoleUser}
+}
+
+var (
+	tokenCheckMu sync.RWMutex
+	tokenCheck   func(token *jwt.Token) error
+)
+
+// SetTokenCheck sets the check of the revocation of the tokens and of the blocking of their login, nil disables it.
+// The errors it returns are *ProblemError.
+func SetTokenCheck(check func(token *jwt.Token) error) {
+	tokenCheckMu.Lock()
+	defer tokenCheckMu.Unlock()
+	tokenCheck = check
+}
+
+// CheckToken applies the check set by SetTokenCheck to a valid token, or to a new one before it is issued
+func CheckToken(token *jwt.Token) error {
+	tokenCheckMu.RLock()
+	check := tokenCheck
+	tokenCheckMu.RUnlock()
+	if check == nil {
+		return nil
+	}
+	return check(token)
+}
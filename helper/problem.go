@@ -0,0 +1,179 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package helper
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// ProblemContentType is the media type of the problem responses (RFC 7807)
+const ProblemContentType = "application/problem+json"
+
+// The problem types. They are stable codes the clients can rely on, unlike the titles and details.
+const (
+	ProblemInvalidBody            = "invalid-body"
+	ProblemBodyTooLarge           = "body-too-large"
+	ProblemTokenMissing           = "token-missing"
+	ProblemTokenMalformed         = "token-malformed"
+	ProblemTokenExpired           = "token-expired"
+	ProblemTokenInvalid           = "token-invalid"
+	ProblemTokenRevoked           = "token-revoked"
+	ProblemInsufficientScope      = "insufficient-scope"
+	ProblemLoginMismatch          = "login-mismatch"
+	ProblemLoginBlocked           = "login-blocked"
+	ProblemInsufficientRole       = "insufficient-role"
+	ProblemInvalidName            = "invalid-name"
+	ProblemInvalidKey             = "invalid-key"
+	ProblemChallengeInvalid       = "challenge-invalid"
+	ProblemProofInvalid           = "proof-invalid"
+	ProblemCrossSignatureRequired = "cross-signature-required"
+	ProblemCrossSignatureInvalid  = "cross-signature-invalid"
+	ProblemPrekeyInvalid          = "prekey-invalid"
+	ProblemPKAlreadyExists        = "pk-already-exists"
+	ProblemPKNotFound             = "pk-not-found"
+	ProblemPreconditionFailed     = "precondition-failed"
+	ProblemOAuthCodeRejected      = "oauth-code-rejected"
+	ProblemOAuthProviderError     = "oauth-provider-error"
+	ProblemUpstreamError          = "upstream-error"
+	ProblemRateLimited            = "rate-limited"
+	ProblemNotFound               = "not-found"
+	ProblemMethodNotAllowed       = "method-not-allowed"
+	ProblemInternalError          = "internal-error"
+)
+
+var problemTitles = map[string]string{
+	ProblemInvalidBody:            "The request body is invalid",
+	ProblemBodyTooLarge:           "The request body is too large",
+	ProblemTokenMissing:           "No token in the request",
+	ProblemTokenMalformed:         "The token is malformed",
+	ProblemTokenExpired:           "The token is expired or not active yet",
+	ProblemTokenInvalid:           "The token is invalid",
+	ProblemTokenRevoked:           "The token has been revoked",
+	ProblemInsufficientScope:      "The token doesn't grant the required scope",
+	ProblemLoginMismatch:          "The login doesn't match the token",
+	ProblemLoginBlocked:           "The login is blocked",
+	ProblemInsufficientRole:       "The token doesn't grant the required role",
+	ProblemInvalidName:            "The login or the device ID can't be used",
+	ProblemInvalidKey:             "The public key doesn't parse as its declared type",
+	ProblemChallengeInvalid:       "The challenge is unknown, expired or already answered",
+	ProblemProofInvalid:           "The possession of the private key couldn't be proven",
+	ProblemCrossSignatureRequired: "The key must be cross-signed by the master key or a trusted device",
+	ProblemCrossSignatureInvalid:  "The cross-signature of the key is invalid",
+	ProblemPrekeyInvalid:          "The prekeys are invalid",
+	ProblemPKAlreadyExists:        "A public key is already registered for this device",
+	ProblemPKNotFound:             "Public key not found",
+	ProblemPreconditionFailed:     "The resource changed since it was read",
+	ProblemOAuthCodeRejected:      "The OAuth provider rejected the authorization code",
+	ProblemOAuthProviderError:     "The OAuth provider couldn't be reached",
+	ProblemUpstreamError:          "The upstream server couldn't be reached",
+	ProblemRateLimited:            "Too many requests",
+	ProblemNotFound:               "Not found",
+	ProblemMethodNotAllowed:       "Method not allowed",
+	ProblemInternalError:          "Internal server error",
+}
+
+// Problem is an error response body following RFC 7807
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// NewProblem returns a problem of the given type
+func NewProblem(status int, problemType, detail string) Problem {
+	title, ok := problemTitles[problemType]
+	if !ok {
+		title = http.StatusText(status)
+	}
+	return Problem{Type: problemType, Title: title, Status: status, Detail: detail}
+}
+
+// WriteProblem writes the problem as the response
+func WriteProblem(w http.ResponseWriter, p Problem) {
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// ProblemError is an error carrying the problem response to write
+type ProblemError struct {
+	Problem
+	Err error // the cause, logged but not sent to the client
+}
+
+// NewProblemError returns an error carrying a problem of the given type
+func NewProblemError(status int, problemType, detail string, err error) *ProblemError {
+	return &ProblemError{Problem: NewProblem(status, problemType, detail), Err: err}
+}
+
+func (e *ProblemError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s\nError was: %s", e.Type, e.Detail, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Type, e.Detail)
+}
+
+// problemCarrier is implemented by the errors that know their problem response
+type problemCarrier interface {
+	ToProblem() Problem
+}
+
+// ToProblem implements problemCarrier
+func (e *ProblemError) ToProblem() Problem {
+	return e.Problem
+}
+
+// WriteError writes the problem response of the error, an internal error if it doesn't carry one
+func WriteError(w http.ResponseWriter, err error) {
+	if carrier, ok := err.(problemCarrier); ok {
+		WriteProblem(w, carrier.ToProblem())
+		return
+	}
+	WriteProblem(w, NewProblem(http.StatusInternalServerError, ProblemInternalError, ""))
+}
+
+// TokenProblem returns the problem of a JWT validation error returned by IsJWTValid
+func TokenProblem(err error) *ProblemError {
+	problemType := ProblemTokenInvalid
+	if jwtErr, ok := err.(*JWTError); ok {
+		switch jwtErr.Reason {
+		case "missing":
+			problemType = ProblemTokenMissing
+		case "malformed":
+			problemType = ProblemTokenMalformed
+		case "expired":
+			problemType = ProblemTokenExpired
+		}
+	}
+	return NewProblemError(http.StatusUnauthorized, problemType, "Authenticate with a valid JWT in the Authorization header.", err)
+}
+
+// NotFoundHandler writes a not-found problem
+func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	WriteProblem(w, NewProblem(http.StatusNotFound, ProblemNotFound, fmt.Sprintf("No route for %s.", r.URL.Path)))
+}
+
+// MethodNotAllowedHandler writes a method-not-allowed problem
+func MethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	WriteProblem(w, NewProblem(http.StatusMethodNotAllowed, ProblemMethodNotAllowed, fmt.Sprintf("%s is not allowed on %s.", r.Method, r.URL.Path)))
+}
@@ -0,0 +1,193 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package helper
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/logging"
+)
+
+// certCheckInterval is the minimal interval between two checks of the certificate files modification time
+const certCheckInterval = 10 * time.Second
+
+// TLSVersions maps the accepted values of the min_version setting to the TLS versions
+var TLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// CipherPolicies maps the accepted values of the cipher_policy setting to the cipher suites (TLS 1.0 to 1.2).
+// The default policy uses the Go defaults, the modern one only allows forward secrecy with AEAD ciphers.
+var CipherPolicies = map[string][]uint16{
+	"default": nil,
+	"modern": {
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	},
+}
+
+// CertReloader serves a certificate and reloads it when the certificate or key file changes
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex // guards the fields below
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewCertReloader loads the certificate and its private key
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *CertReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load the TLS certificate: %v", err)
+	}
+	cr.cert = &cert
+	cr.modTime = cr.filesModTime()
+	return nil
+}
+
+// filesModTime returns the latest modification time of the certificate and key files
+func (cr *CertReloader) filesModTime() time.Time {
+	var latest time.Time
+	for _, file := range []string{cr.certFile, cr.keyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// GetCertificate is meant to be used as tls.Config.GetCertificate.
+// If the files have changed but the new certificate can't be loaded, the previous one is kept.
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if time.Since(cr.lastCheck) > certCheckInterval {
+		cr.lastCheck = time.Now()
+		if !cr.filesModTime().Equal(cr.modTime) {
+			if err := cr.load(); err != nil {
+				logging.Log.WithError(err).Error("TLS certificate reload failed, keeping the current one")
+			} else {
+				logging.Log.Info("TLS certificate reloaded")
+			}
+		}
+	}
+	return cr.cert, nil
+}
+
+// NewTLSConfig creates the server TLS config. If clientCAFile is not empty, the client certificates signed
+// by one of its CAs are verified (they are optional, so that the browsers can still connect).
+func NewTLSConfig(cr *CertReloader, minVersion, cipherPolicy, clientCAFile string) (*tls.Config, error) {
+	version, ok := TLSVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("Unknown TLS version: %s", minVersion)
+	}
+	ciphers, ok := CipherPolicies[cipherPolicy]
+	if !ok {
+		return nil, fmt.Errorf("Unknown cipher policy: %s", cipherPolicy)
+	}
+	tlsConf := &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		MinVersion:     version,
+		CipherSuites:   ciphers,
+	}
+	if clientCAFile != "" {
+		pemCerts, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load the client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("No certificate found in the client CA file %s", clientCAFile)
+		}
+		tlsConf.ClientCAs = pool
+		tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConf, nil
+}
+
+// GenerateSelfSignedCert generates a self-signed ECDSA P-256 certificate valid one year for the given hosts.
+// It is only meant for development.
+func GenerateSelfSignedCert(hosts []string) (certPEM []byte, keyPEM []byte, err error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Mute Authentication Proxy (development)"}},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
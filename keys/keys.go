@@ -0,0 +1,214 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package keys validates the public keys registered on the key server and computes their canonical form and fingerprint
+package keys
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// The supported key types
+const (
+	TypeECDHP256  = "jwk-ecdh-p256"  // P-256 ECDH key as a JWK
+	TypeECDSAP256 = "jwk-ecdsa-p256" // P-256 ECDSA key as a JWK
+	TypeEd25519   = "ed25519"        // raw Ed25519 key, base64 encoded
+	TypeX25519    = "x25519"         // raw X25519 key, base64 encoded
+	TypeOpenPGP   = "openpgp"        // armored OpenPGP public key
+	// TypeLegacy is the type of the keys stored before the types were checked, it can't be registered
+	TypeLegacy = "legacy"
+)
+
+// Types are the key types that can be registered
+var Types = []string{TypeECDHP256, TypeECDSAP256, TypeEd25519, TypeX25519, TypeOpenPGP}
+
+// Key is a public key in its canonical form
+type Key struct {
+	Type        string `json:"type"`
+	PK          string `json:"pk"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// InvalidKeyError is returned when a key can't be parsed as its declared type
+type InvalidKeyError struct {
+	Type string
+	msg  string
+}
+
+func (e *InvalidKeyError) Error() string {
+	if e.Type == "" {
+		return e.msg
+	}
+	return fmt.Sprintf("Invalid %s key: %s", e.Type, e.msg)
+}
+
+func invalid(keyType, format string, a ...interface{}) error {
+	return &InvalidKeyError{Type: keyType, msg: fmt.Sprintf(format, a...)}
+}
+
+// Parse validates pk as a key of the given type and returns its canonical form.
+// The returned errors are *InvalidKeyError.
+func Parse(keyType, pk string) (Key, error) {
+	switch keyType {
+	case TypeECDHP256:
+		return parseJWK(keyType, "enc", pk)
+	case TypeECDSAP256:
+		return parseJWK(keyType, "sig", pk)
+	case TypeEd25519, TypeX25519:
+		return parseRaw25519(keyType, pk)
+	case TypeOpenPGP:
+		return parseOpenPGP(pk)
+	default:
+		return Key{}, unsupportedType(keyType)
+	}
+}
+
+func unsupportedType(keyType string) error {
+	if keyType == "" {
+		return invalid("", "The key type is missing, it should be one of %s", strings.Join(Types, ", "))
+	}
+	return invalid("", "Unsupported key type %q, it should be one of %s", keyType, strings.Join(Types, ", "))
+}
+
+// Legacy wraps a key stored before the types were checked
+func Legacy(pk string) Key {
+	return Key{Type: TypeLegacy, PK: pk, Fingerprint: thumbprint([]byte(pk))}
+}
+
+// thumbprint is the fingerprint of the keys that don't define their own: the base64url encoded SHA-256 digest
+func thumbprint(b []byte) string {
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// jwk holds the JWK members that are checked, the others (key_ops, ext, kid...) are dropped
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	D   string `json:"d"`
+	Use string `json:"use"`
+}
+
+// parseJWK validates a P-256 public JWK. Its canonical form holds the required members only, in the
+// lexicographic order of RFC 7638, so its fingerprint is the JWK thumbprint.
+func parseJWK(keyType, use, pk string) (Key, error) {
+	var k jwk
+	if err := json.Unmarshal([]byte(pk), &k); err != nil {
+		return Key{}, invalid(keyType, "not a JWK: %s", err)
+	}
+	if k.Kty != "EC" || k.Crv != "P-256" {
+		return Key{}, invalid(keyType, "kty should be EC and crv P-256, got %q and %q", k.Kty, k.Crv)
+	}
+	if k.D != "" {
+		return Key{}, invalid(keyType, "this is a private key")
+	}
+	if k.Use != "" && k.Use != use {
+		return Key{}, invalid(keyType, "use should be %q, got %q", use, k.Use)
+	}
+	x, err := decodeCoordinate(k.X)
+	if err != nil {
+		return Key{}, invalid(keyType, "x: %s", err)
+	}
+	y, err := decodeCoordinate(k.Y)
+	if err != nil {
+		return Key{}, invalid(keyType, "y: %s", err)
+	}
+	if !elliptic.P256().IsOnCurve(new(big.Int).SetBytes(x), new(big.Int).SetBytes(y)) {
+		return Key{}, invalid(keyType, "the point isn't on the P-256 curve")
+	}
+	canonical := fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+		base64.RawURLEncoding.EncodeToString(x), base64.RawURLEncoding.EncodeToString(y))
+	return Key{Type: keyType, PK: canonical, Fingerprint: thumbprint([]byte(canonical))}, nil
+}
+
+func decodeCoordinate(s string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, fmt.Errorf("not base64url encoded")
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("should be 32 bytes long, got %d", len(b))
+	}
+	return b, nil
+}
+
+// parseRaw25519 validates a raw Curve25519 key, given in standard or URL base64 with or without padding.
+// Its canonical form is the padded standard base64 encoding.
+func parseRaw25519(keyType, pk string) (Key, error) {
+	b, err := decodeBase64(pk)
+	if err != nil {
+		return Key{}, invalid(keyType, "not base64 encoded")
+	}
+	if len(b) != 32 {
+		return Key{}, invalid(keyType, "should be 32 bytes long, got %d", len(b))
+	}
+	if bytes.Equal(b, make([]byte, 32)) {
+		return Key{}, invalid(keyType, "the key is all zeros")
+	}
+	return Key{Type: keyType, PK: base64.StdEncoding.EncodeToString(b), Fingerprint: thumbprint(b)}, nil
+}
+
+// decodeBase64 decodes standard or URL base64, with or without padding
+func decodeBase64(s string) ([]byte, error) {
+	raw := strings.TrimRight(strings.TrimSpace(s), "=")
+	b, err := base64.RawStdEncoding.DecodeString(raw)
+	if err != nil {
+		b, err = base64.RawURLEncoding.DecodeString(raw)
+	}
+	return b, err
+}
+
+// parseOpenPGP validates an armored OpenPGP public key holding a single entity. Its canonical form is the
+// entity re-armored without the unknown packets, its fingerprint is the OpenPGP v4 fingerprint.
+func parseOpenPGP(pk string) (Key, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(pk))
+	if err != nil {
+		return Key{}, invalid(TypeOpenPGP, "%s", err)
+	}
+	if len(entities) != 1 {
+		return Key{}, invalid(TypeOpenPGP, "should hold one key, got %d", len(entities))
+	}
+	entity := entities[0]
+	if entity.PrivateKey != nil {
+		return Key{}, invalid(TypeOpenPGP, "this is a private key")
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return Key{}, invalid(TypeOpenPGP, "%s", err)
+	}
+	if err = entity.Serialize(w); err != nil {
+		return Key{}, invalid(TypeOpenPGP, "%s", err)
+	}
+	if err = w.Close(); err != nil {
+		return Key{}, invalid(TypeOpenPGP, "%s", err)
+	}
+	buf.WriteByte('\n')
+	return Key{Type: TypeOpenPGP, PK: buf.String(), Fingerprint: fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)}, nil
+}
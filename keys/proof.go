@@ -0,0 +1,189 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package keys
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// Challenge is a proof-of-possession challenge for a key type, bound to a login and a device. Signing keys
+// answer it with a signature of its Message. Key agreement keys (ECDH, X25519) can't sign: they answer with
+// the HMAC-SHA256 of the Message keyed by the shared secret computed with the ephemeral ServerKey.
+type Challenge struct {
+	Type      string `json:"type"`
+	Login     string `json:"login"`
+	Device    string `json:"device,omitempty"` // empty for the master key
+	Nonce     string `json:"nonce"`
+	ServerKey string `json:"server_key,omitempty"` // same format as the keys of Type
+}
+
+// InvalidProofError is returned when the answer to a challenge doesn't verify
+type InvalidProofError struct {
+	msg string
+}
+
+func (e *InvalidProofError) Error() string {
+	return e.msg
+}
+
+func invalidProof(format string, a ...interface{}) error {
+	return &InvalidProofError{msg: fmt.Sprintf(format, a...)}
+}
+
+// NewChallenge returns a challenge with a random nonce for the key of the given type of a device, or of the
+// master key when device is empty. The private part of the ServerKey is derived from the nonce and the seed,
+// so that it is never stored.
+func NewChallenge(keyType, login, device string, seed []byte) (Challenge, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return Challenge{}, err
+	}
+	c := Challenge{Type: keyType, Login: login, Device: device, Nonce: base64.RawURLEncoding.EncodeToString(nonce)}
+	var curve ecdh.Curve
+	switch keyType {
+	case TypeECDSAP256, TypeEd25519, TypeOpenPGP:
+		return c, nil
+	case TypeECDHP256:
+		curve = ecdh.P256()
+	case TypeX25519:
+		curve = ecdh.X25519()
+	default:
+		return Challenge{}, unsupportedType(keyType)
+	}
+	secret, err := serverSecret(curve, seed, c.Nonce)
+	if err != nil {
+		return Challenge{}, err
+	}
+	public := secret.PublicKey().Bytes()
+	if keyType == TypeECDHP256 {
+		// uncompressed point: 0x04 || x || y
+		c.ServerKey = fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+			base64.RawURLEncoding.EncodeToString(public[1:33]), base64.RawURLEncoding.EncodeToString(public[33:]))
+	} else {
+		c.ServerKey = base64.StdEncoding.EncodeToString(public)
+	}
+	return c, nil
+}
+
+// Verify checks that proof answers the challenge with the private key matching key, seed is the one
+// the challenge was created with. The returned errors are *InvalidProofError.
+func (c Challenge) Verify(key Key, proof string, seed []byte) error {
+	if key.Type != c.Type {
+		return invalidProof("The challenge was issued for a %s key, not a %s key", c.Type, key.Type)
+	}
+	if proof == "" {
+		return invalidProof("The signature of the challenge is missing")
+	}
+	switch key.Type {
+	case TypeECDHP256, TypeX25519:
+		return c.verifyKeyAgreement(key, proof, seed)
+	default:
+		return VerifySignature(key, c.Message(), proof)
+	}
+}
+
+// Message is the statement signed to answer the challenge
+func (c Challenge) Message() []byte {
+	return ChallengeMessage(c.Login, c.Device, c.Nonce)
+}
+
+// ChallengeMessage is the statement signed to answer a challenge, device is empty for the master key
+func ChallengeMessage(login, device, nonce string) []byte {
+	return []byte(fmt.Sprintf("mute-auth-proxy challenge v1\n%s\n%s\n%s", login, device, nonce))
+}
+
+// verifyKeyAgreement expects the base64 encoded HMAC-SHA256 of the message keyed by the shared secret
+func (c Challenge) verifyKeyAgreement(key Key, proof string, seed []byte) error {
+	var curve ecdh.Curve
+	var raw []byte
+	if key.Type == TypeECDHP256 {
+		curve = ecdh.P256()
+		x, y, err := jwkPoint(key.PK)
+		if err != nil {
+			return invalidProof("%s", err)
+		}
+		raw = append([]byte{4}, append(x.FillBytes(make([]byte, 32)), y.FillBytes(make([]byte, 32))...)...)
+	} else {
+		curve = ecdh.X25519()
+		var err error
+		if raw, err = base64.StdEncoding.DecodeString(key.PK); err != nil {
+			return invalidProof("%s", err)
+		}
+	}
+	secret, err := serverSecret(curve, seed, c.Nonce)
+	if err != nil {
+		return invalidProof("%s", err)
+	}
+	pub, err := curve.NewPublicKey(raw)
+	if err != nil {
+		return invalidProof("%s", err)
+	}
+	shared, err := secret.ECDH(pub)
+	if err != nil {
+		return invalidProof("%s", err)
+	}
+	mac, err := decodeBase64(proof)
+	if err != nil {
+		return invalidProof("The proof should be base64 encoded")
+	}
+	h := hmac.New(sha256.New, shared)
+	h.Write(c.Message())
+	if !hmac.Equal(mac, h.Sum(nil)) {
+		return invalidProof("The HMAC of the challenge doesn't verify")
+	}
+	return nil
+}
+
+// serverSecret derives the private part of the ServerKey of a challenge from the seed and the nonce.
+// A P-256 scalar that is zero or not below the order of the curve is derived again with the next counter.
+func serverSecret(curve ecdh.Curve, seed []byte, nonce string) (*ecdh.PrivateKey, error) {
+	var err error
+	for counter := 0; counter < 8; counter++ {
+		h := hmac.New(sha256.New, seed)
+		fmt.Fprintf(h, "mute-auth-proxy challenge server key v1\n%d\n%s", counter, nonce)
+		var secret *ecdh.PrivateKey
+		if secret, err = curve.NewPrivateKey(h.Sum(nil)); err == nil {
+			return secret, nil
+		}
+	}
+	return nil, err
+}
+
+// jwkPoint returns the coordinates of a canonical P-256 JWK
+func jwkPoint(pk string) (x, y *big.Int, err error) {
+	var k jwk
+	if err = json.Unmarshal([]byte(pk), &k); err != nil {
+		return nil, nil, err
+	}
+	bx, err := decodeCoordinate(k.X)
+	if err != nil {
+		return nil, nil, err
+	}
+	by, err := decodeCoordinate(k.Y)
+	if err != nil {
+		return nil, nil, err
+	}
+	return new(big.Int).SetBytes(bx), new(big.Int).SetBytes(by), nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package keys
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+)
+
+func TestChallengeMessage(t *testing.T) {
+	want := "mute-auth-proxy challenge v1\nalice\nlaptop\nnonce"
+	if got := string(ChallengeMessage("alice", "laptop", "nonce")); got != want {
+		t.Errorf("ChallengeMessage() = %q, want %q", got, want)
+	}
+	c := Challenge{Login: "alice", Nonce: "nonce"}
+	if got := string(c.Message()); got != "mute-auth-proxy challenge v1\nalice\n\nnonce" {
+		t.Errorf("master key Message() = %q", got)
+	}
+}
+
+func TestVerifySignedChallenge(t *testing.T) {
+	seed := []byte("seed")
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	key, err := Parse(TypeEd25519, base64.StdEncoding.EncodeToString(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewChallenge(TypeEd25519, "alice", "laptop", seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(priv ed25519.PrivateKey, message []byte) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(priv, message))
+	}
+	tests := []struct {
+		name    string
+		key     Key
+		proof   string
+		wantErr bool
+	}{
+		{"framed message", key, sign(priv, c.Message()), false},
+		{"bare nonce", key, sign(priv, []byte(c.Nonce)), true},
+		{"other device", key, sign(priv, ChallengeMessage("alice", "phone", c.Nonce)), true},
+		{"other login", key, sign(priv, ChallengeMessage("bob", "laptop", c.Nonce)), true},
+		{"other private key", key, sign(otherPriv, c.Message()), true},
+		{"missing proof", key, "", true},
+		{"other key type", Key{Type: TypeECDSAP256, PK: key.PK}, sign(priv, c.Message()), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := c.Verify(tt.key, tt.proof, seed)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Verify() error = %v, want error %t", err, tt.wantErr)
+			}
+			if _, ok := err.(*InvalidProofError); err != nil && !ok {
+				t.Errorf("Verify() error %T, want *InvalidProofError", err)
+			}
+		})
+	}
+}
+
+func TestVerifyKeyAgreementChallenge(t *testing.T) {
+	seed := []byte("seed")
+	priv, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	key, err := Parse(TypeX25519, base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewChallenge(TypeX25519, "alice", "laptop", seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ServerKey == "" {
+		t.Fatal("the challenge has no server key")
+	}
+	serverKey, _ := base64.StdEncoding.DecodeString(c.ServerKey)
+	serverPub, err := ecdh.X25519().NewPublicKey(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, _ := priv.ECDH(serverPub)
+	mac := func(message []byte) string {
+		h := hmac.New(sha256.New, shared)
+		h.Write(message)
+		return base64.StdEncoding.EncodeToString(h.Sum(nil))
+	}
+	tests := []struct {
+		name    string
+		seed    []byte
+		proof   string
+		wantErr bool
+	}{
+		{"framed message", seed, mac(c.Message()), false},
+		{"bare nonce", seed, mac([]byte(c.Nonce)), true},
+		{"other device", seed, mac(ChallengeMessage("alice", "phone", c.Nonce)), true},
+		{"other seed", []byte("other seed"), mac(c.Message()), true},
+		{"not base64", seed, "!!", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := c.Verify(key, tt.proof, tt.seed)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Verify() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package keys
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// CanSign returns true if the keys of the type can sign
+func CanSign(keyType string) bool {
+	return keyType == TypeEd25519 || keyType == TypeECDSAP256 || keyType == TypeOpenPGP
+}
+
+// CanAgree returns true if the keys of the type are key agreement keys
+func CanAgree(keyType string) bool {
+	return keyType == TypeX25519 || keyType == TypeECDHP256
+}
+
+// CrossSignMessage is the statement signed to vouch for key as the key of subject (a device or the master key) of login
+func CrossSignMessage(login, subject string, key Key) []byte {
+	return []byte(fmt.Sprintf("mute-auth-proxy cross-signature v1\n%s\n%s\n%s\n%s", login, subject, key.Type, key.Fingerprint))
+}
+
+// SignedPrekeyMessage is the statement signed by the key of a device to publish a signed prekey
+func SignedPrekeyMessage(login, device string, id uint32, prekey Key) []byte {
+	return []byte(fmt.Sprintf("mute-auth-proxy signed-prekey v1\n%s\n%s\n%d\n%s\n%s", login, device, id, prekey.Type, prekey.Fingerprint))
+}
+
+// VerifySignature checks that signature is a signature of message by key:
+//   - ed25519: the Ed25519 signature, base64
+//   - jwk-ecdsa-p256: the ECDSA P-256 SHA-256 signature, r || s (WebCrypto) or ASN.1 DER, base64
+//   - openpgp: an armored detached signature
+//
+// The returned errors are *InvalidProofError.
+func VerifySignature(key Key, message []byte, signature string) error {
+	switch key.Type {
+	case TypeEd25519:
+		return verifyEd25519(key, message, signature)
+	case TypeECDSAP256:
+		return verifyECDSA(key, message, signature)
+	case TypeOpenPGP:
+		return verifyOpenPGP(key, message, signature)
+	default:
+		return invalidProof("%s keys can't sign", key.Type)
+	}
+}
+
+func verifyEd25519(key Key, message []byte, signature string) error {
+	pub, err := base64.StdEncoding.DecodeString(key.PK)
+	if err != nil {
+		return invalidProof("%s", err)
+	}
+	sig, err := decodeBase64(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return invalidProof("The signature should be a base64 encoded Ed25519 signature")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), message, sig) {
+		return invalidProof("The Ed25519 signature doesn't verify")
+	}
+	return nil
+}
+
+func verifyECDSA(key Key, message []byte, signature string) error {
+	x, y, err := jwkPoint(key.PK)
+	if err != nil {
+		return invalidProof("%s", err)
+	}
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	sig, err := decodeBase64(signature)
+	if err != nil {
+		return invalidProof("The signature should be base64 encoded")
+	}
+	digest := sha256.Sum256(message)
+	var ok bool
+	if len(sig) == 64 {
+		ok = ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	} else {
+		ok = ecdsa.VerifyASN1(pub, digest[:], sig)
+	}
+	if !ok {
+		return invalidProof("The ECDSA signature doesn't verify")
+	}
+	return nil
+}
+
+func verifyOpenPGP(key Key, message []byte, signature string) error {
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key.PK))
+	if err != nil {
+		return invalidProof("%s", err)
+	}
+	_, err = openpgp.CheckArmoredDetachedSignature(keyring, strings.NewReader(string(message)), strings.NewReader(signature))
+	if err != nil {
+		return invalidProof("The OpenPGP signature doesn't verify: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package logging provides the structured and levelled logger of the proxy
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Formats are the accepted values of the log format setting
+var Formats = []string{"logfmt", "json"}
+
+// Levels are the accepted values of the log level setting, the logrus level names
+var Levels = []string{"trace", "debug", "info", "warn", "warning", "error", "fatal", "panic"}
+
+// Log is the logger of the proxy, configured by Setup
+var Log = logrus.New()
+
+// redacted replaces the values of the sensitive fields
+const redacted = "[REDACTED]"
+
+// sensitiveFields are the fields whose values are redacted unless redaction is disabled
+var sensitiveFields = map[string]bool{
+	"token":         true,
+	"access_token":  true,
+	"authorization": true,
+	"secret":        true,
+	"client_secret": true,
+	"code":          true,
+	"key":           true,
+	"pk":            true,
+	"body":          true,
+}
+
+func init() {
+	Log.SetOutput(os.Stderr)
+	Log.SetFormatter(newFormatter("logfmt"))
+	Log.AddHook(redactHook{})
+}
+
+// Setup sets the level and the format of the logger, and whether the sensitive fields are redacted.
+// The standard logger is redirected to it, so that the remaining log.Printf calls are structured too.
+func Setup(level, format string, redact bool) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	if !ValidFormat(format) {
+		return fmt.Errorf("Unknown log format: %s", format)
+	}
+	Log.SetLevel(lvl)
+	Log.SetFormatter(newFormatter(format))
+	Log.ReplaceHooks(make(logrus.LevelHooks))
+	if redact {
+		Log.AddHook(redactHook{})
+	}
+	log.SetFlags(0)
+	log.SetOutput(stdWriter{})
+	return nil
+}
+
+// ValidFormat returns true if format is one of the Formats
+func ValidFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+func newFormatter(format string) logrus.Formatter {
+	if format == "json" {
+		return &logrus.JSONFormatter{}
+	}
+	return &logrus.TextFormatter{DisableColors: true, FullTimestamp: true}
+}
+
+// redactHook replaces the values of the sensitive fields before the entry is written
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	for field := range entry.Data {
+		if sensitiveFields[strings.ToLower(field)] {
+			entry.Data[field] = redacted
+		}
+	}
+	return nil
+}
+
+// stdWriter writes the lines of the standard logger as info entries. It logs synchronously,
+// so that the message of a log.Fatal is written before the exit.
+type stdWriter struct{}
+
+var _ io.Writer = stdWriter{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	Log.Info(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader is the header carrying the request ID, it is forwarded to the botstorage
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID matches the request IDs accepted from the clients
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type contextKey struct{}
+
+// requestLog holds the fields logged with every entry of a request
+type requestLog struct {
+	mu     sync.Mutex
+	fields logrus.Fields
+}
+
+// statusRecorder keeps the status code written by the handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets the streaming handlers flush through the recorder
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection through the recorder
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Middleware gives an ID to each request, reusing the one sent by the client if valid, and logs the request once served
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		rl := &requestLog{fields: logrus.Fields{
+			"request_id": id,
+			"route":      route,
+			"method":     r.Method,
+			"remote":     r.RemoteAddr,
+		}}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), contextKey{}, rl)))
+
+		entry := rl.entry().WithFields(logrus.Fields{
+			"status":      rec.status,
+			"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+		})
+		if rec.status >= http.StatusInternalServerError {
+			entry.Warn("Request served")
+		} else {
+			entry.Info("Request served")
+		}
+	})
+}
+
+func (rl *requestLog) entry() *logrus.Entry {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return Log.WithFields(rl.fields)
+}
+
+// FromRequest returns an entry carrying the fields of the request (request ID, route, login...)
+func FromRequest(r *http.Request) *logrus.Entry {
+	if rl, ok := r.Context().Value(contextKey{}).(*requestLog); ok {
+		return rl.entry()
+	}
+	return logrus.NewEntry(Log)
+}
+
+// AddFields adds fields (the login or the provider for example) to all the next entries of the request,
+// including the one written once the request is served
+func AddFields(r *http.Request, fields logrus.Fields) {
+	rl, ok := r.Context().Value(contextKey{}).(*requestLog)
+	if !ok {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for k, v := range fields {
+		rl.fields[k] = v
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,192 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package metrics exposes the Prometheus metrics of the proxy
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "mute_auth_proxy"
+
+// Outcomes of the key store operations and of the upstream requests
+const (
+	OutcomeOK       = "ok"
+	OutcomeNotFound = "not_found"
+	OutcomeError    = "error"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the HTTP requests by route, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+	oauthExchanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "oauth_exchanges_total",
+		Help:      "Number of OAuth exchanges (code exchanges and client credentials grants) by provider and outcome.",
+	}, []string{"provider", "outcome"})
+	jwtFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jwt_validation_failures_total",
+		Help:      "Number of JWT validation failures by reason.",
+	}, []string{"reason"})
+	keyStoreOps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "keystore_operations_total",
+		Help:      "Number of key store operations by operation and outcome.",
+	}, []string{"operation", "outcome"})
+	keyStoreDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "keystore_operation_duration_seconds",
+		Help:      "Latency of the key store operations by operation.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation"})
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Number of requests rejected by the rate limiter by route group.",
+	}, []string{"group"})
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Latency of the requests proxied to the ConiksServer and the BotStorage by upstream and outcome.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"upstream", "outcome"})
+	webhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Number of webhook delivery attempts by outcome (delivered, retried or dead_lettered).",
+	}, []string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, oauthExchanges, jwtFailures, keyStoreOps, keyStoreDuration, rateLimited, upstreamDuration, webhookDeliveries)
+}
+
+// Handler returns the handler of the /metrics route
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// statusRecorder keeps the status code written by the handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets the streaming handlers flush through the recorder
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection through the recorder
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Middleware counts the requests and measures their latency, labelled by the mux route template
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		status := strconv.Itoa(rec.status)
+		httpRequests.WithLabelValues(route, r.Method, status).Inc()
+		httpDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// OAuthExchange counts an OAuth exchange
+func OAuthExchange(provider, outcome string) {
+	oauthExchanges.WithLabelValues(provider, outcome).Inc()
+}
+
+// JWTValidationFailure counts a JWT validation failure
+func JWTValidationFailure(reason string) {
+	jwtFailures.WithLabelValues(reason).Inc()
+}
+
+// KeyStoreOperation counts a key store operation started at start
+func KeyStoreOperation(operation string, start time.Time, outcome string) {
+	keyStoreOps.WithLabelValues(operation, outcome).Inc()
+	keyStoreDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// RateLimited counts a request rejected by the rate limiter
+func RateLimited(group string) {
+	rateLimited.WithLabelValues(group).Inc()
+}
+
+// UpstreamRequest measures a request to an upstream (coniks or botstorage) started at start
+func UpstreamRequest(upstream string, start time.Time, err error) {
+	outcome := OutcomeOK
+	if err != nil {
+		outcome = OutcomeError
+	}
+	upstreamDuration.WithLabelValues(upstream, outcome).Observe(time.Since(start).Seconds())
+}
+
+// WebhookDelivery counts a webhook delivery attempt
+func WebhookDelivery(outcome string) {
+	webhookDeliveries.WithLabelValues(outcome).Inc()
+}
+
+// upstreamRoundTripper measures the requests sent through the wrapped RoundTripper
+type upstreamRoundTripper struct {
+	upstream string
+	next     http.RoundTripper
+}
+
+func (rt *upstreamRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := rt.next.RoundTrip(r)
+	UpstreamRequest(rt.upstream, start, err)
+	return resp, err
+}
+
+// InstrumentRoundTripper returns a RoundTripper measuring the latency of the requests sent to the upstream
+func InstrumentRoundTripper(upstream string, next http.RoundTripper) http.RoundTripper {
+	return &upstreamRoundTripper{upstream: upstream, next: next}
+}
@@ -0,0 +1,152 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package ratelimit throttles the requests with token buckets keyed by login and/or client IP
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/coast-team/mute-auth-proxy/metrics"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// The accepted values of the key setting of a policy
+const (
+	KeyIP    = "ip"
+	KeyLogin = "login" // falls back to the IP when the request has no valid JWT
+	KeyBoth  = "both"  // the request must be allowed by both the login and the IP buckets
+)
+
+// Limit is the size and the refill rate of a token bucket
+type Limit struct {
+	Rate  float64 // tokens per second
+	Burst int     // capacity of the bucket
+}
+
+// Store keeps the state of the token buckets. MemoryStore keeps them in the process,
+// a shared store is needed to apply the limits across several instances.
+type Store interface {
+	// Take takes a token from the bucket of the key. If the bucket is empty, it returns false
+	// and how long to wait for the next token.
+	Take(key string, limit Limit, now time.Time) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// Policy is the limit applied to a route group and how the requests are keyed
+type Policy struct {
+	Limit
+	Key string
+}
+
+// Limiter applies the policies of the route groups with a store
+type Limiter struct {
+	store       Store
+	trustedHops int
+}
+
+// New creates a limiter. If trustedHops is positive, the client IP is taken from the X-Forwarded-For
+// header, which must then be appended to by that many trusted reverse proxies.
+func New(store Store, trustedHops int) *Limiter {
+	return &Limiter{store: store, trustedHops: trustedHops}
+}
+
+// Middleware returns a middleware throttling the requests of the route group with the policy.
+// Throttled requests get a 429 with a Retry-After header.
+func (l *Limiter) Middleware(group string, policy Policy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			now := time.Now()
+			for _, key := range l.keys(r, policy.Key) {
+				allowed, retryAfter, err := l.store.Take(group+":"+key, policy.Limit, now)
+				if err != nil {
+					// the limiter must not take the service down, the request is let through
+					logging.FromRequest(r).WithError(err).Error("Rate limiter store failed")
+					continue
+				}
+				if !allowed {
+					metrics.RateLimited(group)
+					logging.FromRequest(r).WithField("limit_key", key).Info("Rate limited")
+					retrySeconds := int(math.Ceil(retryAfter.Seconds()))
+					w.Header().Set("Retry-After", strconv.Itoa(retrySeconds))
+					helper.WriteProblem(w, helper.NewProblem(http.StatusTooManyRequests, helper.ProblemRateLimited,
+						fmt.Sprintf("Retry in %d seconds.", retrySeconds)))
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// keys returns the bucket keys of the request
+func (l *Limiter) keys(r *http.Request, keyBy string) []string {
+	ip := "ip:" + l.clientIP(r)
+	if keyBy == KeyIP {
+		return []string{ip}
+	}
+	login := requestLogin(r)
+	if login == "" {
+		return []string{ip}
+	}
+	if keyBy == KeyLogin {
+		return []string{"login:" + login}
+	}
+	return []string{"login:" + login, ip}
+}
+
+// clientIP returns the IP of the client. Each proxy appends the address it got the request from to X-Forwarded-For,
+// so the entries on the left are set by the client: the IP is the entry added by the farthest trusted proxy.
+func (l *Limiter) clientIP(r *http.Request) string {
+	if l.trustedHops > 0 {
+		var entries []string
+		for _, header := range r.Header["X-Forwarded-For"] {
+			entries = append(entries, strings.Split(header, ",")...)
+		}
+		// with fewer entries, the request didn't go through all the trusted proxies
+		if len(entries) >= l.trustedHops {
+			if ip := strings.TrimSpace(entries[len(entries)-l.trustedHops]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestLogin returns the login of the valid JWT (or client certificate) of the request, if any
+func requestLogin(r *http.Request) string {
+	if r.Header.Get("Authorization") == "" && r.TLS == nil {
+		return ""
+	}
+	token, err := helper.Authenticate(r)
+	if err != nil || token == nil || !token.Valid {
+		return ""
+	}
+	login, _ := token.Claims.(jwt.MapClaims)["login"].(string)
+	return login
+}
@@ -0,0 +1,359 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package webhook POSTs the audited events to the webhook subscriptions. The deliveries are queued in the
+// key store and retried with an exponential backoff, the ones that keep failing are kept as dead letters.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/coast-team/mute-auth-proxy/audit"
+	"github.com/coast-team/mute-auth-proxy/config"
+	"github.com/coast-team/mute-auth-proxy/helper"
+	"github.com/coast-team/mute-auth-proxy/logging"
+	"github.com/coast-team/mute-auth-proxy/metrics"
+	"github.com/dgraph-io/badger"
+	"github.com/sirupsen/logrus"
+)
+
+// The headers of a delivery. The signature is the hex HMAC-SHA256, keyed by the secret of the subscription,
+// of the timestamp, a dot and the body.
+const (
+	DeliveryHeader  = "X-Mute-Delivery"
+	EventHeader     = "X-Mute-Event"
+	TimestampHeader = "X-Mute-Timestamp"
+	SignatureHeader = "X-Mute-Signature"
+)
+
+const (
+	queuePrefix = "!webhook:queue:" // the pending deliveries, ordered by next attempt
+	deadPrefix  = "!webhook:dead:"  // the dead letters, ordered by failure
+	batchSize   = 100               // deliveries read from the queue at once
+)
+
+// Payload is the JSON body of a delivery
+type Payload struct {
+	ID       string    `json:"id"`
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Login    string    `json:"login,omitempty"`
+	Device   string    `json:"device,omitempty"`
+	Actor    string    `json:"actor,omitempty"`
+	Provider string    `json:"provider,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// Delivery is a payload queued for a subscription
+type Delivery struct {
+	ID           string          `json:"id"`
+	Subscription int             `json:"subscription"` // the index of the subscription in the webhooks section
+	URL          string          `json:"url"`
+	Event        string          `json:"event"`
+	Payload      json.RawMessage `json:"payload"`
+	Attempts     int             `json:"attempts"`
+	NextAttempt  time.Time       `json:"next_attempt"`
+	LastError    string          `json:"last_error,omitempty"`
+	CreatedAt    time.Time       `json:"created_at"`
+}
+
+func (d Delivery) queueKey() []byte {
+	return []byte(fmt.Sprintf("%s%020d:%s", queuePrefix, d.NextAttempt.UnixNano(), d.ID))
+}
+
+func (d Delivery) deadKey(at time.Time) []byte {
+	return []byte(fmt.Sprintf("%s%020d:%s", deadPrefix, at.UnixNano(), d.ID))
+}
+
+// Dispatcher queues the events of the subscriptions and delivers them
+type Dispatcher struct {
+	db     *badger.DB
+	conf   config.WebhooksConfig
+	client *http.Client
+	wake   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewDispatcher returns the dispatcher of the subscriptions of the webhooks section, Run must be called to deliver the queued events
+func NewDispatcher(db *badger.DB, conf config.WebhooksConfig) *Dispatcher {
+	return &Dispatcher{db: db, conf: conf, client: &http.Client{Timeout: conf.Timeout.Duration},
+		wake: make(chan struct{}, 1), stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Enqueue queues the event for the subscriptions it matches in a single transaction, it is the observer of the audit log
+func (d *Dispatcher) Enqueue(e audit.Entry) {
+	var deliveries []Delivery
+	for i, sub := range d.conf.Subscriptions {
+		if !helper.StringInSlice(e.Event, sub.Events) {
+			continue
+		}
+		id, err := newID()
+		if err != nil {
+			logging.Log.WithError(err).Error("Webhook: couldn't generate a delivery ID")
+			return
+		}
+		payload, err := json.Marshal(Payload{ID: id, Event: e.Event, Time: e.Time, Login: e.Login, Device: e.Device,
+			Actor: e.Actor, Provider: e.Provider, Detail: e.Detail})
+		if err != nil {
+			logging.Log.WithError(err).Error("Webhook: couldn't encode the payload")
+			return
+		}
+		deliveries = append(deliveries, Delivery{ID: id, Subscription: i, URL: sub.URL, Event: e.Event, Payload: payload, NextAttempt: e.Time, CreatedAt: e.Time})
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+	err := d.db.Update(func(txn *badger.Txn) error {
+		for _, delivery := range deliveries {
+			value, err := json.Marshal(delivery)
+			if err != nil {
+				return err
+			}
+			if err = txn.Set(delivery.queueKey(), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Log.WithError(err).WithFields(logrus.Fields{"event": e.Event, "deliveries": len(deliveries)}).Error("Webhook: couldn't queue the deliveries")
+		return
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers the queued events until Stop is called
+func (d *Dispatcher) Run() {
+	defer close(d.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		d.deliverDue()
+		select {
+		case <-d.wake:
+		case <-ticker.C:
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the dispatcher and waits for the delivery in progress, the pending ones stay queued
+func (d *Dispatcher) Stop() {
+	close(d.stop)
+	<-d.done
+}
+
+// deliverDue attempts the deliveries whose time has come
+func (d *Dispatcher) deliverDue() {
+	for {
+		due, err := d.readDue(time.Now())
+		if err != nil {
+			logging.Log.WithError(err).Error("Webhook: couldn't read the queue")
+			return
+		}
+		for _, delivery := range due {
+			select {
+			case <-d.stop:
+				return
+			default:
+			}
+			d.attempt(delivery)
+		}
+		if len(due) < batchSize {
+			return
+		}
+	}
+}
+
+// readDue returns the first queued deliveries due at now
+func (d *Dispatcher) readDue(now time.Time) ([]Delivery, error) {
+	var due []Delivery
+	err := d.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(queuePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix) && len(due) < batchSize; it.Next() {
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			var delivery Delivery
+			if err = json.Unmarshal(value, &delivery); err != nil {
+				return err
+			}
+			if delivery.NextAttempt.After(now) {
+				break
+			}
+			due = append(due, delivery)
+		}
+		return nil
+	})
+	return due, err
+}
+
+// attempt sends the delivery, then removes it from the queue, queues its retry or dead-letters it
+func (d *Dispatcher) attempt(delivery Delivery) {
+	log := logging.Log.WithFields(logrus.Fields{"delivery": delivery.ID, "event": delivery.Event, "url": delivery.URL})
+	err := d.send(delivery)
+	old := delivery.queueKey()
+	now := time.Now()
+	delivery.Attempts++
+	var next []byte
+	switch {
+	case err == nil:
+		metrics.WebhookDelivery("delivered")
+		log.WithField("attempts", delivery.Attempts).Debug("Webhook delivered")
+	case delivery.Attempts >= d.conf.MaxAttempts:
+		delivery.LastError = err.Error()
+		next = delivery.deadKey(now)
+		metrics.WebhookDelivery("dead_lettered")
+		log.WithError(err).WithField("attempts", delivery.Attempts).Error("Webhook delivery failed, dead-lettered")
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttempt = now.Add(d.backoff(delivery.Attempts))
+		next = delivery.queueKey()
+		metrics.WebhookDelivery("retried")
+		log.WithError(err).WithFields(logrus.Fields{"attempts": delivery.Attempts, "next_attempt": delivery.NextAttempt}).Warn("Webhook delivery failed, retrying")
+	}
+	value, err := json.Marshal(delivery)
+	if err == nil {
+		err = d.db.Update(func(txn *badger.Txn) error {
+			if err := txn.Delete(old); err != nil {
+				return err
+			}
+			if next == nil {
+				return nil
+			}
+			return txn.Set(next, value)
+		})
+	}
+	if err != nil {
+		log.WithError(err).Error("Webhook: couldn't update the queue")
+	}
+}
+
+// backoff returns the delay before the next attempt, after the given number of attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.conf.InitialBackoff.Duration
+	for i := 1; i < attempts && delay < d.conf.MaxBackoff.Duration; i++ {
+		delay *= 2
+	}
+	if delay > d.conf.MaxBackoff.Duration {
+		delay = d.conf.MaxBackoff.Duration
+	}
+	return delay
+}
+
+// send POSTs the payload signed with the secret of its subscription, any status but 2xx is a failure.
+// The subscription must still be at the same place in the webhooks section with the same URL.
+func (d *Dispatcher) send(delivery Delivery) error {
+	subs := d.conf.Subscriptions
+	if delivery.Subscription < 0 || delivery.Subscription >= len(subs) || subs[delivery.Subscription].URL != delivery.URL {
+		return fmt.Errorf("no subscription %d for %s any more", delivery.Subscription, delivery.URL)
+	}
+	secret := subs[delivery.Subscription].Secret.Value()
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, "sha256="+Sign(secret, timestamp, delivery.Payload))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", delivery.URL, resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the signature of a payload sent at timestamp (in seconds since the epoch)
+func Sign(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DeadLetters returns the dead-lettered deliveries, the oldest first
+func DeadLetters(db *badger.DB) ([]Delivery, error) {
+	deliveries := []Delivery{}
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(deadPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			var delivery Delivery
+			if err = json.Unmarshal(value, &delivery); err != nil {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+		}
+		return nil
+	})
+	return deliveries, err
+}
+
+// MakeDeadLettersHandler is the handler listing the dead-lettered deliveries
+func MakeDeadLettersHandler(db *badger.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deliveries, err := DeadLetters(db)
+		if err != nil {
+			helper.WriteError(w, err)
+			logging.Log.WithError(err).Error("Webhook: couldn't list the dead letters")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(deliveries)
+	}
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,27 @@
+// Copyright 2017-2018 Jean-Philippe Eisenbarth
+//
+// This file is part of Mute Authentication Proxy.
+//
+// Mute Authentication Proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Mute Authentication Proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Mute Authentication Proxy. See the file COPYING.  If not, see <http://www.gnu.org/licenses/>.
+
+package webhook
+
+import "testing"
+
+func TestSign(t *testing.T) {
+	got := Sign("whsec-0123456789abcdef0123456789", "1760875200", []byte(`{"event":"login"}`))
+	if want := "f162eacc538739e4d1d49f145dcb2aa623cc2e29f68a768ee619ce11e5307a40"; got != want {
+		t.Errorf("Sign() = %s, want %s", got, want)
+	}
+}